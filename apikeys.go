@@ -0,0 +1,223 @@
+package users
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// apiKeyPrefix tells API keys apart from JWTs in the Authorization header
+const apiKeyPrefix = "grf_"
+
+const apiKeyKey contextKey = "users.apikey"
+
+// APIKey is a personal access token for machine clients.
+// Only the hash of the secret is stored, the secret is shown once on creation.
+// Scopes are permission names, space separated in the database.
+type APIKey struct {
+	gorm.Model
+	UserID     uint       `json:"userID" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-" gorm:"unique;not null"`
+	Scopes     string     `json:"-"`
+	ScopeList  []string   `json:"scopes" gorm:"-"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type APIKeys []APIKey
+
+type APIKeyCreate struct {
+	Name      string     `json:"name" valid:"required"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type APIKeyCreated struct {
+	APIKey
+	Secret string `json:"secret"`
+}
+
+func (k *APIKey) AfterFind() error {
+	k.ScopeList = strings.Fields(k.Scopes)
+	return nil
+}
+
+func (k APIKey) hasScope(permission string) bool {
+	for _, v := range strings.Fields(k.Scopes) {
+		if v == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func isAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func currentAPIKey(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyKey).(APIKey)
+	return key, ok
+}
+
+// userHasRole checks the primary and the additional roles of the user
+func userHasRole(user User, roles []string) bool {
+	for _, v := range roles {
+		if user.Role == v {
+			return true
+		}
+		for _, role := range user.Roles {
+			if role.Name == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// protectAPIKey is the API key counterpart of App.Protect. It attaches the key
+// and a session carrying the key owner, so handlers work the same for both.
+func protectAPIKey(next http.HandlerFunc, roles []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			key  APIKey
+			user User
+			rsp  = core.Response{Req: r}
+			now  = time.Now()
+		)
+
+		App.DB.Where("key_hash = ?", App.ToSum256(bearerToken(r))).First(&key)
+		if key.ID != 0 {
+			App.DB.Preload("Roles").First(&user, key.UserID)
+		}
+
+		if key.ID == 0 || (key.ExpiresAt != nil && key.ExpiresAt.Before(now)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			rsp.Errors.Add("token", "API key is not valid")
+			w.Write(rsp.Make())
+			return
+		}
+
+		if user.ID == 0 || user.Status != "active" || !userHasRole(user, roles) {
+			w.WriteHeader(http.StatusForbidden)
+			rsp.Errors.Add("token", "Permission denied")
+			w.Write(rsp.Make())
+			return
+		}
+
+		if passwordExpired(user) {
+			w.WriteHeader(http.StatusForbidden)
+			rsp.Errors.Add("password", "password_expired")
+			w.Write(rsp.Make())
+			return
+		}
+
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > time.Minute {
+			App.DB.Model(&key).UpdateColumn("last_used_at", now)
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyKey, key)
+		ctx = context.WithValue(ctx, sessionKey, Session{UserID: user.ID, LastSeenAt: now})
+
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func actionAPIKeyGetAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		keys APIKeys
+		rsp  = core.Response{Data: &keys, Req: r}
+	)
+
+	App.DB.Where("user_id = ?", currentUserID(r)).Order("id DESC").Find(&keys)
+
+	rsp.Data = &keys
+	rsp.Count = int64(len(keys))
+
+	w.Write(rsp.Make())
+}
+
+// actionAPIKeyCreate only accepts scopes the user holds,
+// and keys can not be used to create further keys
+func actionAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data APIKeyCreate
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			userID := currentUserID(r)
+			_, byKey := currentAPIKey(r)
+
+			missing := ""
+			for _, v := range data.Scopes {
+				if !hasPermission(userID, v) {
+					missing = v
+					break
+				}
+			}
+
+			if byKey {
+				w.WriteHeader(http.StatusForbidden)
+				rsp.Errors.Add("token", "API keys can not create API keys")
+			} else if missing != "" {
+				rsp.Errors.Add("scopes", "Permission not held: "+missing)
+			} else if data.ExpiresAt != nil && data.ExpiresAt.Before(time.Now()) {
+				rsp.Errors.Add("expiresAt", "Expiry must be in the future")
+			} else if secret, err := randomToken(32); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("name", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				secret = apiKeyPrefix + secret
+				key := APIKey{
+					UserID:    userID,
+					Name:      data.Name,
+					Prefix:    secret[:len(apiKeyPrefix)+6],
+					KeyHash:   App.ToSum256(secret),
+					Scopes:    strings.Join(data.Scopes, " "),
+					ExpiresAt: data.ExpiresAt,
+				}
+				if err := App.DB.Create(&key).Error; err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("name", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else {
+					key.ScopeList = data.Scopes
+					rsp.Data = &APIKeyCreated{APIKey: key, Secret: secret}
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionAPIKeyDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		key APIKey
+		rsp = core.Response{Data: &key, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.Where("user_id = ?", currentUserID(r)).First(&key, vars["kid"])
+
+	if key.ID == 0 {
+		rsp.Errors.Add("kid", "API key not found")
+	} else if err := App.DB.Unscoped().Delete(&key).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("kid", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	w.Write(rsp.Make())
+}
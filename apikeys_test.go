@@ -0,0 +1,119 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+)
+
+type TestAPIKey struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   APIKeyCreated   `json:"data"`
+}
+
+func readAPIKeyBody(r *http.Response) TestAPIKey {
+	var k TestAPIKey
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &k)
+	defer r.Body.Close()
+	return k
+}
+
+//"/api/users/me/apikeys", protectAuth(actionAPIKeyCreate)).Methods("POST")
+func TestAPIKeys(t *testing.T) {
+	var u UserData
+
+	admin := loginAdmin(t)
+	user := loginTestUser(t)
+
+	resp := doRequest(Murl+"/me/apikeys", "POST", `{"name":"script", "scopes":["users.read"]}`, user.Data.Token)
+
+	k := readAPIKeyBody(resp)
+
+	if len(k.Errors) == 0 {
+		t.Fatal("scope not held by the user accepted")
+	}
+
+	resp = doRequest(Murl+"/me/apikeys", "POST", `{"name":"script", "scopes":["users.read"]}`, admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	k = readAPIKeyBody(resp)
+
+	if len(k.Errors) != 0 {
+		t.Fatal(k.Errors)
+	}
+
+	if k.Data.Secret == "" {
+		t.Fatal("secret not returned")
+	}
+
+	secret := k.Data.Secret
+
+	//"/api/users/{id}", ProtectPermission(actionGetOne, "users.read")).Methods("GET")
+	resp = doRequest(fmt.Sprintf("%s/%d", Murl, admin.Data.ID), "GET", "", secret)
+
+	u.Read(resp)
+
+	if u.Data.Email != "admin@admin.a" {
+		t.Fatal("API key does not act as its owner")
+	}
+
+	//routes without a permission are closed to keys
+	resp = doRequest(Murl+"/me", "GET", "", secret)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/orgs", "POST", `{"name":"keyorg"}`, secret)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl, "GET", "", secret)
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/999999999", "DELETE", "", secret)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/me/apikeys", "POST", `{"name":"nested"}`, secret)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	//"/api/users/me/apikeys/{kid}", protectAuth(actionAPIKeyDelete)).Methods("DELETE")
+	resp = doRequest(fmt.Sprintf("%s/me/apikeys/%d", Murl, k.Data.ID), "DELETE", "", admin.Data.Token)
+
+	k = readAPIKeyBody(resp)
+
+	if len(k.Errors) != 0 {
+		t.Fatal(k.Errors)
+	}
+
+	resp = doRequest(Murl, "GET", "", secret)
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Unauthorized expected: %d", resp.StatusCode)
+	}
+
+	return
+}
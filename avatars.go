@@ -0,0 +1,252 @@
+package users
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+)
+
+// avatar types by sniffed content type, the value is the image.Decode format
+var avatarTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/gif":  "gif",
+}
+
+func init() {
+	//an avatar is a link to the uploaded image, never the image itself,
+	//and only uploads may point it into the avatar store
+	govalidator.TagMap["avatarurl"] = govalidator.Validator(func(str string) bool {
+		return isAvatarURL(str) && !isStoredAvatar(str)
+	})
+}
+
+// ownAvatarKey returns the store key behind the avatar URL when it is
+// one storeAvatar issued for the user, other URLs are never deleted
+func ownAvatarKey(userID uint, avatar string) (string, bool) {
+	prefix := avatarStore.URL(fmt.Sprintf("avatars/%d/", userID))
+	name := strings.TrimPrefix(avatar, prefix)
+	if name == avatar || name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		return "", false
+	}
+	return fmt.Sprintf("avatars/%d/%s", userID, name), true
+}
+
+func isStoredAvatar(str string) bool {
+	return avatarStore != nil && strings.HasPrefix(str, avatarStore.URL("avatars/"))
+}
+
+func isAvatarURL(str string) bool {
+	u, err := url.Parse(str)
+	if err != nil || len(str) > 2048 {
+		return false
+	}
+	if u.Scheme == "" {
+		return u.Host == "" && strings.HasPrefix(u.Path, "/")
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// checkAvatar sniffs the type and decodes the image, the dimensions are
+// checked from the header first so a small file can not inflate to a huge bitmap
+func checkAvatar(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	format, ok := avatarTypes[contentType]
+	if !ok {
+		return "", errors.New("Avatar must be a PNG, JPEG or GIF image")
+	}
+
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return "", errors.New("Avatar is not a valid image")
+	}
+
+	if config.Width > Config.AvatarMaxDimension || config.Height > Config.AvatarMaxDimension {
+		return "", fmt.Errorf("Avatar must be at most %d pixels wide and high", Config.AvatarMaxDimension)
+	}
+
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return "", errors.New("Avatar is not a valid image")
+	}
+
+	return contentType, nil
+}
+
+// storeAvatar saves the image under a new key and points the profile at it.
+// The previous image is deleted once the profile is updated, if it is one
+// of the user's own uploads.
+func storeAvatar(user *User, data []byte, contentType string) error {
+	name, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("avatars/%d/%s.%s", user.ID, name, avatarTypes[contentType])
+	if err := avatarStore.Put(key, data, contentType); err != nil {
+		return err
+	}
+
+	previous := user.Profile.Avatar
+	if err := updateProfile(user, Profile{Avatar: avatarStore.URL(key)}); err != nil {
+		avatarStore.Delete(key)
+		return err
+	}
+
+	if key, ok := ownAvatarKey(user.ID, previous); ok {
+		if err := avatarStore.Delete(key); err != nil {
+			log.Println("Avatar deleting error: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// readAvatar reads the "avatar" file of the multipart form, at most Config.AvatarMaxBytes of it
+func readAvatar(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	//room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, Config.AvatarMaxBytes+64*1024)
+
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		return nil, errors.New("Avatar file is missing or too large")
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, Config.AvatarMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > Config.AvatarMaxBytes {
+		return nil, fmt.Errorf("Avatar must be at most %d bytes", Config.AvatarMaxBytes)
+	}
+
+	return data, nil
+}
+
+func uploadAvatar(w http.ResponseWriter, r *http.Request, userID interface{}) {
+	var (
+		user User
+		rsp  = core.Response{Req: r}
+	)
+
+	App.DB.Preload("Profile").First(&user, userID)
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else if data, err := readAvatar(w, r); err != nil {
+		rsp.Errors.Add("avatar", err.Error())
+	} else if contentType, err := checkAvatar(data); err != nil {
+		rsp.Errors.Add("avatar", err.Error())
+	} else if err := storeAvatar(&user, data, contentType); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("avatar", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	} else {
+		App.DB.First(&user.Profile, user.ProfileID)
+		rsp.Data = &user.Profile
+	}
+
+	w.Write(rsp.Make())
+}
+
+// serveAvatars registers the file route of the local avatar store
+// unless Config.AvatarBaseURL is a full URL served elsewhere
+func serveAvatars() {
+	if Config.AvatarBaseURL == "" {
+		log.Fatal("Config.AvatarBaseURL is required without Config.AvatarStore")
+	}
+	if !strings.HasPrefix(Config.AvatarBaseURL, "/") {
+		return
+	}
+
+	files := http.FileServer(http.Dir(Config.AvatarDir))
+	route := strings.TrimRight(Config.AvatarBaseURL, "/") + "/{key:.+}"
+
+	App.R.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		//no directory listings
+		if strings.HasSuffix(key, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + key
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r2)
+	}).Methods("GET", "HEAD")
+}
+
+func actionAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uploadAvatar(w, r, vars["id"])
+}
+
+func actionMeAvatarUpload(w http.ResponseWriter, r *http.Request) {
+	uploadAvatar(w, r, currentUserID(r))
+}
+
+// migrateAvatars moves avatars stored inline as data URIs into the avatar store.
+// A profile only changes once its image is stored, values that can not be
+// moved are logged and left for the operator.
+func migrateAvatars() {
+	var profiles []Profile
+	App.DB.Where("avatar IS NOT NULL AND avatar <> ''").Find(&profiles)
+
+	for _, p := range profiles {
+		if isAvatarURL(p.Avatar) {
+			continue
+		}
+
+		var user User
+		App.DB.Where("profile_id = ?", p.ID).First(&user)
+		user.Profile = p
+
+		data, ok := decodeDataURI(p.Avatar)
+		if !ok || user.ID == 0 {
+			log.Printf("Avatar migration skipped profile %d: not an image or no user", p.ID)
+			continue
+		}
+
+		contentType, err := checkAvatar(data)
+		if err == nil {
+			err = storeAvatar(&user, data, contentType)
+		}
+		if err != nil {
+			log.Printf("Avatar migration skipped profile %d: %s", p.ID, err.Error())
+		}
+	}
+}
+
+// decodeDataURI accepts "data:<type>;base64,<data>" and bare base64
+func decodeDataURI(s string) ([]byte, bool) {
+	if strings.HasPrefix(s, "data:") {
+		i := strings.Index(s, ";base64,")
+		if i < 0 {
+			return nil, false
+		}
+		s = s[i+len(";base64,"):]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	return data, err == nil
+}
@@ -0,0 +1,210 @@
+package users
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps uploaded files, see LocalBlobStore and S3BlobStore
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	Delete(key string) error
+	// URL is where clients fetch the blob from
+	URL(key string) string
+}
+
+var errBlobKey = errors.New("invalid blob key")
+
+// avatarStore is Config.AvatarStore or the local default, set on Configure
+var avatarStore BlobStore
+
+func newBlobStore() BlobStore {
+	if Config.AvatarStore != nil {
+		return Config.AvatarStore
+	}
+	return LocalBlobStore{Dir: Config.AvatarDir, BaseURL: Config.AvatarBaseURL}
+}
+
+func validBlobKey(key string) bool {
+	return key != "" && !strings.HasPrefix(key, "/") && !strings.Contains(key, "..")
+}
+
+// LocalBlobStore writes blobs below Dir. As the default avatar store
+// Configure serves Dir under a path BaseURL, a front web server has to serve it otherwise.
+type LocalBlobStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s LocalBlobStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s LocalBlobStore) Put(key string, data []byte, contentType string) error {
+	if !validBlobKey(key) {
+		return errBlobKey
+	}
+
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func (s LocalBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return errBlobKey
+	}
+
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s LocalBlobStore) URL(key string) string {
+	return strings.TrimRight(s.BaseURL, "/") + "/" + key
+}
+
+// S3BlobStore talks to S3 or a compatible service such as MinIO with
+// path style requests signed by AWS Signature Version 4
+type S3BlobStore struct {
+	// Endpoint is the service URL, for example https://s3.eu-central-1.amazonaws.com
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PublicURL is where the bucket is served from, Endpoint/Bucket when empty
+	PublicURL string
+	// Client sends the requests, s3Client when nil
+	Client *http.Client
+}
+
+// s3Client bounds the requests, http.DefaultClient would wait forever on a hung endpoint
+var s3Client = &http.Client{Timeout: 30 * time.Second}
+
+func (s S3BlobStore) objectURL(key string) string {
+	return strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + key
+}
+
+func (s S3BlobStore) do(method, key string, data []byte, contentType string) error {
+	if !validBlobKey(key) {
+		return errBlobKey
+	}
+
+	req, err := http.NewRequest(method, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, data, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = s3Client
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, body)
+	}
+
+	return nil
+}
+
+func (s S3BlobStore) Put(key string, data []byte, contentType string) error {
+	return s.do("PUT", key, data, contentType)
+}
+
+func (s S3BlobStore) Delete(key string) error {
+	return s.do("DELETE", key, nil, "")
+}
+
+func (s S3BlobStore) URL(key string) string {
+	if s.PublicURL != "" {
+		return strings.TrimRight(s.PublicURL, "/") + "/" + key
+	}
+	return s.objectURL(key)
+}
+
+// sign adds the x-amz headers and the Authorization header,
+// every header already set on req is signed
+func (s S3BlobStore) sign(req *http.Request, payload []byte, now time.Time) {
+	var (
+		amzDate = now.UTC().Format("20060102T150405Z")
+		date    = amzDate[:8]
+		scope   = date + "/" + s.Region + "/s3/aws4_request"
+		sum     = sha256.Sum256(payload)
+	)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	requestSum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+hex.EncodeToString(hmacSHA256(key, stringToSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
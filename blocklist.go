@@ -0,0 +1,177 @@
+package users
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// Blocklist is a bloom filter of SHA-1 password hashes. It answers
+// "maybe blocked" or "certainly not blocked", a false positive only
+// makes a user pick another password.
+type Blocklist struct {
+	bits []uint64
+	m    uint64
+	k    uint64
+}
+
+// passwordBlocklist is loaded from Config.PasswordBlocklist on Configure
+var passwordBlocklist *Blocklist
+
+// NewBlocklist sizes the filter for n entries at the false positive rate p
+func NewBlocklist(n int, p float64) *Blocklist {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	return &Blocklist{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// positions derives the k bit positions from the digest by double hashing,
+// SHA-1 output is already uniform so no further hashing is needed
+func (b *Blocklist) positions(sum [sha1.Size]byte, fn func(uint64)) {
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16]) | 1
+
+	for i := uint64(0); i < b.k; i++ {
+		fn((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *Blocklist) AddHash(sum [sha1.Size]byte) {
+	b.positions(sum, func(pos uint64) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+func (b *Blocklist) HasHash(sum [sha1.Size]byte) bool {
+	found := true
+	b.positions(sum, func(pos uint64) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+func (b *Blocklist) Add(password string) {
+	b.AddHash(sha1.Sum([]byte(password)))
+}
+
+// Contains checks the password as typed and lowercased,
+// common password lists are mostly lowercase
+func (b *Blocklist) Contains(password string) bool {
+	if b.HasHash(sha1.Sum([]byte(password))) {
+		return true
+	}
+	lower := strings.ToLower(password)
+	return lower != password && b.HasHash(sha1.Sum([]byte(lower)))
+}
+
+// blocklistEntry parses one line of the file. A line is either a plain
+// password or a full SHA-1 hex hash with an optional ":count" suffix, the
+// format of the downloadable breached password lists. Lines of k-anonymity
+// range responses only hold the last 35 hex digits of the hash, the prefix
+// is not in the line, so they are skipped.
+func blocklistEntry(line string) ([sha1.Size]byte, bool) {
+	var sum [sha1.Size]byte
+
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return sum, false
+	}
+
+	hash := line
+	if i := strings.IndexByte(line, ':'); i == 2*sha1.Size {
+		hash = line[:i]
+	} else if i == 2*sha1.Size-5 && isHex(line[:i]) {
+		return sum, false
+	}
+	if len(hash) == 2*sha1.Size {
+		if raw, err := hex.DecodeString(hash); err == nil {
+			copy(sum[:], raw)
+			return sum, true
+		}
+	}
+
+	return sha1.Sum([]byte(line)), true
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s + "0")
+	return err == nil
+}
+
+// LoadBlocklist builds the filter from a file with one entry per line
+func LoadBlocklist(path string, p float64) (*Blocklist, error) {
+	lines, err := countLines(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := NewBlocklist(lines, p)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if sum, ok := blocklistEntry(scanner.Text()); ok {
+			b.AddHash(sum)
+		}
+	}
+
+	return b, scanner.Err()
+}
+
+func countLines(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+
+	return n, scanner.Err()
+}
+
+// loadPasswordBlocklist is called on Configure, a missing file is fatal
+// so a typo in the path can not silently switch the check off
+func loadPasswordBlocklist() error {
+	if Config.PasswordBlocklist == "" {
+		return nil
+	}
+
+	if !(Config.BlocklistErrorRate > 0 && Config.BlocklistErrorRate < 1) {
+		return fmt.Errorf("BlocklistErrorRate must be between 0 and 1, not %v", Config.BlocklistErrorRate)
+	}
+
+	b, err := LoadBlocklist(Config.PasswordBlocklist, Config.BlocklistErrorRate)
+	if err != nil {
+		return err
+	}
+
+	passwordBlocklist = b
+	return nil
+}
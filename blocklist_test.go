@@ -0,0 +1,89 @@
+package users
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	breached := fmt.Sprintf("%X", sha1.Sum([]byte("Breached.Pass1")))
+	f.WriteString("123456\npassword\nqwerty\r\n" + breached + ":42\n")
+	f.Close()
+
+	b, err := LoadBlocklist(f.Name(), 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"123456", "password", "PassWord", "qwerty", "Breached.Pass1"} {
+		if !b.Contains(v) {
+			t.Errorf("%q not blocked", v)
+		}
+	}
+
+	if b.Contains("breached.pass1") {
+		t.Error("hashed entries must match exactly")
+	}
+
+	if _, err := LoadBlocklist(f.Name()+".missing", 0.001); err == nil {
+		t.Error("missing file accepted")
+	}
+}
+
+func TestBlocklistEntry(t *testing.T) {
+	breached := fmt.Sprintf("%X", sha1.Sum([]byte("Breached.Pass1")))
+
+	if sum, ok := blocklistEntry(breached + ":42"); !ok || sum != sha1.Sum([]byte("Breached.Pass1")) {
+		t.Error("full hash not parsed")
+	}
+
+	if _, ok := blocklistEntry(breached[5:] + ":42"); ok {
+		t.Error("range suffix taken as a password")
+	}
+
+	if sum, ok := blocklistEntry("letmein"); !ok || sum != sha1.Sum([]byte("letmein")) {
+		t.Error("plain password not parsed")
+	}
+}
+
+func TestLoadPasswordBlocklistErrorRate(t *testing.T) {
+	saved := Config
+	defer func() { Config = saved }()
+
+	Config.PasswordBlocklist = "unused"
+
+	for _, p := range []float64{0, 1, -0.5, 2} {
+		Config.BlocklistErrorRate = p
+		if err := loadPasswordBlocklist(); err == nil {
+			t.Errorf("error rate %v accepted", p)
+		}
+	}
+}
+
+func TestBlocklistFalsePositives(t *testing.T) {
+	b := NewBlocklist(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		b.Add(fmt.Sprintf("blocked-%d", i))
+	}
+
+	hits := 0
+	for i := 0; i < 10000; i++ {
+		if b.Contains(fmt.Sprintf("allowed-%d", i)) {
+			hits++
+		}
+	}
+
+	//twice the target rate leaves room for chance
+	if hits > 200 {
+		t.Fatalf("%d false positives in 10000 lookups", hits)
+	}
+}
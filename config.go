@@ -0,0 +1,140 @@
+package users
+
+import "time"
+
+// Settings holds the tunable parts of the users module.
+// Change Config before calling Configure to override the defaults.
+type Settings struct {
+	// PasswordHasher is the algorithm used for new password hashes: "bcrypt" or "argon2id"
+	PasswordHasher string
+	BcryptCost     int
+	Argon2         Argon2Params
+	// PasswordPolicy is checked for every new password
+	PasswordPolicy PasswordPolicy
+	// PasswordHistory is how many previous passwords can not be reused, 0 disables the check
+	PasswordHistory int
+	// MaxPasswordAge forces a password change once the password is older, 0 disables it.
+	// Sign in, magic links, token refresh and API keys are refused until then.
+	// PasswordChangeTTL is the lifetime of the token issued for that change.
+	MaxPasswordAge    time.Duration
+	PasswordChangeTTL time.Duration
+	// PasswordBlocklist is a file of common or breached passwords, one per line,
+	// either plain or as full SHA-1 hex with an optional ":count", range files of 35 digit
+	// suffixes are not supported. Empty disables the check.
+	// BlocklistErrorRate is the false positive rate the filter is sized for, between 0 and 1.
+	PasswordBlocklist  string
+	BlocklistErrorRate float64
+	// RefreshTokenTTL is how long an unused refresh token stays valid
+	RefreshTokenTTL time.Duration
+	// JWTSecret signs the access tokens, it must be the HS256 key App.Protect verifies them with
+	JWTSecret []byte
+	// AccessTokenTTL is the lifetime of the access JWTs
+	AccessTokenTTL time.Duration
+	// TrustedProxies are the addresses or CIDRs of the reverse proxies whose
+	// X-Real-IP and X-Forwarded-For headers are believed, empty trusts none
+	TrustedProxies []string
+	// CleanupInterval is how often expired revocations and refresh tokens are purged, 0 disables it
+	CleanupInterval time.Duration
+	// TOTPIssuer is the account issuer shown by authenticator apps
+	TOTPIssuer      string
+	RecoveryCodes   int
+	MFAChallengeTTL time.Duration
+	MFAMaxAttempts  int
+	// lifetimes of the emailed verification tokens
+	ConfirmTokenTTL     time.Duration
+	ResetTokenTTL       time.Duration
+	EmailChangeTokenTTL time.Duration
+	MagicLinkTTL        time.Duration
+	EmailRevertTokenTTL time.Duration
+	OrgInviteTTL        time.Duration
+	// InviteTTL is the default lifetime of registration invitations
+	InviteTTL time.Duration
+	// InviteOnly disables open registration, new users need an invitation
+	InviteOnly bool
+	// ImpersonationTTL is the lifetime of tokens issued to admins acting as a user
+	ImpersonationTTL time.Duration
+	// LockStore keeps failed login counters: "db" or "memory" for single node deployments
+	LockStore string
+	// failures per email and per client IP before every further failure doubles
+	// the wait, starting at LoginBackoffBase and capped at LoginBackoffMax
+	LoginBackoffAfter   int
+	LoginBackoffAfterIP int
+	LoginBackoffBase    time.Duration
+	LoginBackoffMax     time.Duration
+	// LoginAttemptWindow is how long failures are remembered
+	LoginAttemptWindow time.Duration
+	// LockoutThreshold failures per email lock the account for LockoutDuration
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+	// UnlockCallBackUrl is the page the emailed unlock link points to
+	UnlockCallBackUrl string
+	// AvatarStore keeps uploaded avatars. When nil they are written to AvatarDir and served
+	// under AvatarBaseURL, unless that is a full URL served elsewhere. See S3BlobStore for S3 compatible storage.
+	AvatarStore   BlobStore
+	AvatarDir     string
+	AvatarBaseURL string
+	// MigrateAvatars moves avatars stored inline in the profiles into AvatarStore on Configure
+	MigrateAvatars bool
+	// uploads above AvatarMaxBytes or AvatarMaxDimension pixels on a side are rejected
+	AvatarMaxBytes     int64
+	AvatarMaxDimension int
+	// confirmation resend limits per email and per client IP
+	ResendPerEmail int
+	ResendPerIP    int
+	ResendWindow   time.Duration
+}
+
+var Config = Settings{
+	PasswordHasher: "argon2id",
+	BcryptCost:     12,
+	Argon2: Argon2Params{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 2,
+		SaltLen: 16,
+		KeyLen:  32,
+	},
+	PasswordPolicy: PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      128,
+		RequireLower:   true,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		MaxRepeated:    3,
+		ForbidPersonal: true,
+	},
+	PasswordHistory:     5,
+	PasswordChangeTTL:   15 * time.Minute,
+	BlocklistErrorRate:  0.001,
+	RefreshTokenTTL:     30 * 24 * time.Hour,
+	AccessTokenTTL:      24 * time.Hour,
+	CleanupInterval:     time.Hour,
+	TOTPIssuer:          "go-rest-framework",
+	RecoveryCodes:       10,
+	MFAChallengeTTL:     5 * time.Minute,
+	MFAMaxAttempts:      5,
+	ConfirmTokenTTL:     48 * time.Hour,
+	ResetTokenTTL:       time.Hour,
+	EmailChangeTokenTTL: 24 * time.Hour,
+	MagicLinkTTL:        15 * time.Minute,
+	EmailRevertTokenTTL: 7 * 24 * time.Hour,
+	OrgInviteTTL:        7 * 24 * time.Hour,
+	InviteTTL:           7 * 24 * time.Hour,
+	ImpersonationTTL:    15 * time.Minute,
+	LockStore:           "db",
+	LoginBackoffAfter:   3,
+	LoginBackoffAfterIP: 50,
+	LoginBackoffBase:    time.Second,
+	LoginBackoffMax:     5 * time.Minute,
+	LoginAttemptWindow:  time.Hour,
+	LockoutThreshold:    10,
+	LockoutDuration:     30 * time.Minute,
+	AvatarDir:           "uploads",
+	AvatarBaseURL:       "/uploads",
+	AvatarMaxBytes:      2 << 20,
+	AvatarMaxDimension:  4096,
+	ResendPerEmail:      3,
+	ResendPerIP:         10,
+	ResendWindow:        time.Hour,
+}
@@ -0,0 +1,147 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/go-rest-framework/core"
+)
+
+type EmailChange struct {
+	Email       string `json:"email" valid:"email,required,unique~email: Email not unique"`
+	CallBackUrl string `json:"callBackUrl"`
+}
+
+type EmailChangeConfirm struct {
+	Token string `json:"token" valid:"required"`
+}
+
+func emailTaken(email string, exceptID uint) bool {
+	var user User
+	App.DB.Where("email = ? AND id <> ?", email, exceptID).First(&user)
+	return user.ID != 0
+}
+
+func actionEmailChange(w http.ResponseWriter, r *http.Request) {
+	var (
+		data EmailChange
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	govalidator.TagMap["unique"] = govalidator.Validator(func(str string) bool {
+		return !emailTaken(str, 0)
+	})
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			session, ok := currentSession(r)
+			if ok {
+				App.DB.First(&user, session.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("token", "User not found")
+			} else if changeToken, err := issueVerificationToken(user.ID, PurposeEmailChange, data.Email); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("email", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else if revertToken, err := issueVerificationToken(user.ID, PurposeEmailRevert, user.Email); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("email", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.Mail.Send(
+					data.Email,
+					"Email change confirm",
+					"To confirm your new email address, go to the link "+data.CallBackUrl+"?emailtoken="+changeToken,
+				)
+				App.Mail.Send(
+					user.Email,
+					"Email change request",
+					"Your account email is being changed to "+data.Email+
+						". If it was not you, go to the link "+data.CallBackUrl+"?reverttoken="+revertToken,
+				)
+				if App.IsTest {
+					log.Println("To confirm your new email address, go to the link " + data.CallBackUrl + "?emailtoken=" + changeToken)
+				}
+			}
+		}
+	}
+
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
+
+func actionEmailChangeConfirm(w http.ResponseWriter, r *http.Request) {
+	var (
+		data EmailChangeConfirm
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			token, ok := useVerificationToken(data.Token, PurposeEmailChange)
+			if ok {
+				App.DB.First(&user, token.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("token", "Email change link is not valid or has expired")
+			} else if emailTaken(token.Payload, user.ID) {
+				rsp.Errors.Add("email", "Email not unique")
+			} else if res := App.DB.Model(&user).Update("email", token.Payload); res.Error != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("email", "Data saving error")
+				log.Println("Data saving error: " + res.Error.Error())
+			} else {
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+// actionEmailChangeRevert cancels a pending change or restores the old
+// address, every session is ended as the account may be hijacked
+func actionEmailChangeRevert(w http.ResponseWriter, r *http.Request) {
+	var (
+		data EmailChangeConfirm
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			token, ok := useVerificationToken(data.Token, PurposeEmailRevert)
+			if ok {
+				App.DB.First(&user, token.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("token", "Email revert link is not valid or has expired")
+			} else if emailTaken(token.Payload, user.ID) {
+				rsp.Errors.Add("email", "Email not unique")
+			} else if res := App.DB.Model(&user).Update("email", token.Payload); res.Error != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("email", "Data saving error")
+				log.Println("Data saving error: " + res.Error.Error())
+			} else {
+				App.DB.Model(&VerificationToken{}).
+					Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, PurposeEmailChange).
+					Update("used_at", time.Now())
+				revokeUserTokens(user.ID)
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
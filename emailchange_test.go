@@ -0,0 +1,66 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/icrowley/fake"
+)
+
+//"/api/users/me/email", protectAuth(actionEmailChange)).Methods("POST")
+func TestEmailChange(t *testing.T) {
+	var u UserData
+	newEmail := fake.EmailAddress()
+
+	login := loginTestUser(t)
+
+	resp := doRequest(Murl+"/me/email", "POST", `{"email":"admin@admin.a"}`, login.Data.Token)
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("email unique validation dont work")
+	}
+
+	resp = doRequest(Murl+"/me/email", "POST", `{"email":"`+newEmail+`", "callBackUrl":"http://test.ttt"}`, login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	//"/api/users/email/confirm", actionEmailChangeConfirm).Methods("POST")
+	resp = doRequest(Murl+"/email/confirm", "POST", `{"token":"testemailtoken"}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Email != newEmail {
+		t.Fatalf("email not changed, got %s", u.Data.Email)
+	}
+
+	//"/api/users/email/revert", actionEmailChangeRevert).Methods("POST")
+	resp = doRequest(Murl+"/email/revert", "POST", `{"token":"testreverttoken"}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Email != "testuser@test.t" {
+		t.Fatalf("email not reverted, got %s", u.Data.Email)
+	}
+
+	return
+}
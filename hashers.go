@@ -0,0 +1,233 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidHash = errors.New("invalid password hash format")
+
+// PasswordHasher turns a password into a self-describing encoded hash
+// and checks passwords against hashes it produced
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	// Match reports whether the encoded hash was produced by this algorithm
+	Match(encoded string) bool
+	// NeedsRehash reports whether the encoded hash is weaker than the current settings
+	NeedsRehash(encoded string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+// bcryptMaxBytes is the longest password bcrypt accepts,
+// checkPasswordPolicy refuses longer ones while bcrypt is selected
+const bcryptMaxBytes = 72
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h BcryptHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// Argon2idHasher encodes hashes in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type Argon2idHasher struct {
+	Params Argon2Params
+}
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	p := h.Params
+	salt := make([]byte, p.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Time,
+		p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) Match(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := decodeArgon2id(encoded)
+	return err != nil || p != h.Params
+}
+
+func decodeArgon2id(encoded string) (p Argon2Params, salt, key []byte, err error) {
+	var version int
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return p, nil, nil, ErrInvalidHash
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+// Hasher returns the hasher selected by Config.PasswordHasher,
+// Configure refuses other names than "bcrypt" and "argon2id"
+func Hasher() PasswordHasher {
+	switch Config.PasswordHasher {
+	case "bcrypt":
+		return BcryptHasher{Cost: Config.BcryptCost}
+	default:
+		return Argon2idHasher{Params: Config.Argon2}
+	}
+}
+
+func validHasher(name string) bool {
+	return name == "bcrypt" || name == "argon2id"
+}
+
+func hasherFor(encoded string) PasswordHasher {
+	for _, h := range []PasswordHasher{
+		Argon2idHasher{Params: Config.Argon2},
+		BcryptHasher{Cost: Config.BcryptCost},
+	} {
+		if h.Match(encoded) {
+			return h
+		}
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return Hasher().Hash(password)
+}
+
+func isLegacyHash(encoded string) bool {
+	return hasherFor(encoded) == nil
+}
+
+// checkPassword verifies password against the user's stored hash.
+// Hashes that carry no algorithm prefix are the old salted SHA-256 ones.
+func checkPassword(user User, password string) bool {
+	if isLegacyHash(user.Password) {
+		return user.Password != "" &&
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(App.ToSum256(password+user.Salt))) == 1
+	}
+
+	ok, err := hasherFor(user.Password).Verify(password, user.Password)
+	if err != nil {
+		return false
+	}
+
+	return ok
+}
+
+// rehashPassword upgrades a verified password to the configured algorithm
+// and cost when the stored hash is legacy or was made with other settings
+func rehashPassword(user User, password string) {
+	if !isLegacyHash(user.Password) && !Hasher().NeedsRehash(user.Password) {
+		return
+	}
+
+	passhash, err := hashPassword(password)
+	if err != nil {
+		log.Println("Password hashing error: " + err.Error())
+		return
+	}
+
+	res := App.DB.Model(&user).Updates(map[string]interface{}{
+		"password":    passhash,
+		"salt":        "",
+		"legacy_hash": false,
+	})
+	if res.Error != nil {
+		log.Println("Data saving error: " + res.Error.Error())
+	}
+}
+
+// flagLegacyPasswords marks every row still holding an old salted SHA-256 hash
+func flagLegacyPasswords() {
+	App.DB.Model(&User{}).
+		Where("password NOT LIKE ?", "$%").
+		Where("legacy_hash = ?", false).
+		Update("legacy_hash", true)
+}
@@ -0,0 +1,112 @@
+package users
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+	}{
+		{
+			"bcrypt",
+			BcryptHasher{Cost: 4},
+			"$2a$04$",
+		},
+		{
+			"argon2id",
+			Argon2idHasher{Params: Argon2Params{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}},
+			"$argon2id$v=19$m=1024,t=1,p=1$",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.hasher.Hash("good.PASS123")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(encoded, tt.prefix) {
+				t.Errorf("Wrong hash format %s, want prefix %s", encoded, tt.prefix)
+			}
+
+			if !tt.hasher.Match(encoded) {
+				t.Errorf("Hasher does not match its own hash")
+			}
+
+			ok, err := tt.hasher.Verify("good.PASS123", encoded)
+			if err != nil || !ok {
+				t.Errorf("Right password rejected: %v", err)
+			}
+
+			ok, err = tt.hasher.Verify("bad.PASS123", encoded)
+			if err != nil || ok {
+				t.Errorf("Wrong password accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestHasherFor(t *testing.T) {
+	if _, ok := hasherFor("$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$a2V5").(Argon2idHasher); !ok {
+		t.Errorf("argon2id hash not detected")
+	}
+
+	if _, ok := hasherFor("$2a$10$abcdefghijklmnopqrstuv").(BcryptHasher); !ok {
+		t.Errorf("bcrypt hash not detected")
+	}
+
+	if hasherFor("5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8") != nil {
+		t.Errorf("legacy hash detected as modern")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	weak := BcryptHasher{Cost: 4}
+	strong := BcryptHasher{Cost: 5}
+
+	encoded, err := weak.Hash("good.PASS123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if weak.NeedsRehash(encoded) {
+		t.Errorf("Rehash requested for hash with current cost")
+	}
+
+	if !strong.NeedsRehash(encoded) {
+		t.Errorf("No rehash requested after cost change")
+	}
+
+	params := Argon2Params{Time: 1, Memory: 1024, Threads: 1, SaltLen: 16, KeyLen: 32}
+	encoded, err = Argon2idHasher{Params: params}.Hash("good.PASS123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if (Argon2idHasher{Params: params}).NeedsRehash(encoded) {
+		t.Errorf("Rehash requested for hash with current params")
+	}
+
+	params.Time = 2
+	if !(Argon2idHasher{Params: params}).NeedsRehash(encoded) {
+		t.Errorf("No rehash requested after params change")
+	}
+}
+
+func TestValidHasher(t *testing.T) {
+	for _, name := range []string{"bcrypt", "argon2id"} {
+		if !validHasher(name) {
+			t.Errorf("%s refused", name)
+		}
+	}
+
+	for _, name := range []string{"", "bcrpyt", "argon2"} {
+		if validHasher(name) {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
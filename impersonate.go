@@ -0,0 +1,244 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// AuditLog records what an admin did while impersonating a user
+type AuditLog struct {
+	gorm.Model
+	ActorID uint   `json:"actorID" gorm:"index"`
+	UserID  uint   `json:"userID" gorm:"index"`
+	Action  string `json:"action"`
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	IP      string `json:"ip"`
+}
+
+type AuditLogs []AuditLog
+
+// Impersonation is returned instead of the user on POST /users/{id}/impersonate.
+// Sub and Act echo the claims of the token, the act claim is also kept with the session.
+type Impersonation struct {
+	Token     string    `json:"token"`
+	Sub       uint      `json:"sub"`
+	Act       uint      `json:"act"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func audit(r *http.Request, actorID, userID uint, action string) {
+	err := App.DB.Create(&AuditLog{
+		ActorID: actorID,
+		UserID:  userID,
+		Action:  action,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		IP:      clientIP(r),
+	}).Error
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+}
+
+// elevatedPermissions make their holders off limits for impersonation,
+// acting as them would give more than users.impersonate grants
+var elevatedPermissions = []string{
+	"users.impersonate",
+	"roles.manage",
+	"users.create",
+	"users.update",
+	"users.delete",
+	"users.sessions",
+	"users.2fa",
+	"orgs.manage",
+}
+
+// isPrivileged tells if the user holds the admin role or any elevated permission
+func isPrivileged(user User) bool {
+	return userHasRole(user, []string{"admin"}) || hasAnyPermission(user.ID, elevatedPermissions)
+}
+
+// protectOwner is protectAuth for the credentials of the account, which only
+// the user may change. Admins impersonating the user are refused, otherwise
+// they could take the account over beyond Config.ImpersonationTTL.
+func protectOwner(next http.HandlerFunc) http.HandlerFunc {
+	return protectAuth(func(w http.ResponseWriter, r *http.Request) {
+		if session, _ := currentSession(r); session.ActorID != 0 {
+			rsp := core.Response{Req: r}
+			w.WriteHeader(http.StatusForbidden)
+			rsp.Errors.Add("token", "Not allowed while impersonating")
+			w.Write(rsp.Make())
+			return
+		}
+		next(w, r)
+	})
+}
+
+// revokeExpiredImpersonations denylists the access tokens of ended
+// impersonations before cleanupTokens drops their sessions
+func revokeExpiredImpersonations() {
+	var families []string
+
+	App.DB.Model(&Session{}).
+		Where("actor_id <> 0 AND expires_at < ?", time.Now()).
+		Pluck("family", &families)
+
+	for _, family := range families {
+		revokeTokenFamily(family)
+	}
+}
+
+// checkImpersonation ends expired impersonations and audits the others,
+// it is called by protect for every request made with an impersonation token
+func checkImpersonation(w http.ResponseWriter, r *http.Request, session Session) bool {
+	if session.ExpiresAt.Before(time.Now()) {
+		revokeTokenFamily(session.Family)
+		rsp := core.Response{Req: r}
+		w.WriteHeader(http.StatusUnauthorized)
+		rsp.Errors.Add("token", "Impersonation has expired")
+		w.Write(rsp.Make())
+		return false
+	}
+
+	audit(r, session.ActorID, session.UserID, "request")
+	return true
+}
+
+// genImpersonationToken issues an access JWT for the user with a session
+// bound to the actor. No refresh token is handed out, so the
+// impersonation can not outlive Config.ImpersonationTTL.
+func genImpersonationToken(user User, actorID uint, r *http.Request) (Impersonation, error) {
+	var imp Impersonation
+
+	token, claims, err := signAccessToken(&user, Config.ImpersonationTTL, actorID)
+	if err != nil {
+		return imp, err
+	}
+
+	family, err := randomToken(16)
+	if err != nil {
+		return imp, err
+	}
+
+	//the refresh token only maps the access token to its session
+	refresh, err := randomToken(32)
+	if err != nil {
+		return imp, err
+	}
+
+	now := time.Now()
+	expires := now.Add(Config.ImpersonationTTL)
+
+	tx := App.DB.Begin()
+	err = tx.Create(&RefreshToken{
+		UserID:     user.ID,
+		Family:     family,
+		TokenHash:  App.ToSum256(refresh),
+		AccessHash: claims.Id,
+		ExpiresAt:  expires,
+	}).Error
+	if err == nil {
+		err = tx.Create(&Session{
+			UserID:     user.ID,
+			ActorID:    actorID,
+			Family:     family,
+			UserAgent:  "impersonation",
+			IP:         clientIP(r),
+			LastSeenAt: now,
+			ExpiresAt:  expires,
+		}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return imp, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return imp, err
+	}
+
+	imp.Token = token
+	imp.Sub = user.ID
+	imp.Act = actorID
+	imp.ExpiresAt = expires
+
+	return imp, nil
+}
+
+func actionImpersonate(w http.ResponseWriter, r *http.Request) {
+	var (
+		user User
+		rsp  = core.Response{Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.Preload("Roles").First(&user, vars["id"])
+	session, _ := currentSession(r)
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else if session.ActorID != 0 {
+		w.WriteHeader(http.StatusForbidden)
+		rsp.Errors.Add("ID", "Can not impersonate while impersonating")
+	} else if user.ID == session.UserID || isPrivileged(user) {
+		w.WriteHeader(http.StatusForbidden)
+		rsp.Errors.Add("ID", "Privileged users can not be impersonated")
+	} else if user.Status != "active" {
+		rsp.Errors.Add("ID", "User is not active")
+	} else if imp, err := genImpersonationToken(user, session.UserID, r); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("ID", "Error generating JWT token: "+err.Error())
+	} else {
+		audit(r, session.UserID, user.ID, "impersonate")
+		w.Header().Set("Authorization", "Bearer "+imp.Token)
+		rsp.Data = &imp
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionAuditLog(w http.ResponseWriter, r *http.Request) {
+	var (
+		logs   AuditLogs
+		count  int64
+		rsp    = core.Response{Data: &logs, Req: r}
+		actor  = r.FormValue("actor")
+		user   = r.FormValue("user")
+		limit  = r.FormValue("limit")
+		offset = r.FormValue("offset")
+		db     = App.DB.Model(&AuditLog{})
+	)
+
+	if id, err := strconv.Atoi(actor); err == nil {
+		db = db.Where("actor_id = ?", id)
+	}
+
+	if id, err := strconv.Atoi(user); err == nil {
+		db = db.Where("user_id = ?", id)
+	}
+
+	db.Count(&count)
+
+	if limit != "" {
+		db = db.Limit(limit)
+	} else {
+		db = db.Limit(20)
+	}
+
+	if offset != "" {
+		db = db.Offset(offset)
+	}
+
+	db.Order("id DESC").Find(&logs)
+
+	rsp.Data = &logs
+	rsp.Count = count
+
+	w.Write(rsp.Make())
+}
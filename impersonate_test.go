@@ -0,0 +1,160 @@
+package users
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-rest-framework/core"
+)
+
+type TestImpersonation struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   Impersonation   `json:"data"`
+}
+
+type TestAuditLogs struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   AuditLogs       `json:"data"`
+}
+
+func readImpersonationBody(r *http.Response) TestImpersonation {
+	var i TestImpersonation
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &i)
+	defer r.Body.Close()
+	return i
+}
+
+func readAuditLogsBody(r *http.Response) TestAuditLogs {
+	var a TestAuditLogs
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &a)
+	defer r.Body.Close()
+	return a
+}
+
+//"/api/users/{id}/impersonate", ProtectPermission(actionImpersonate, "users.impersonate")).Methods("POST")
+func TestImpersonate(t *testing.T) {
+	var u UserData
+
+	admin := loginAdmin(t)
+
+	resp := doRequest(fmt.Sprintf("%s/%d/impersonate", Murl, admin.Data.ID), "POST", "", admin.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"?email=testuser@test.t", "GET", "", admin.Data.Token)
+
+	users := readUsersBody(resp, t)
+
+	if len(users.Data) != 1 {
+		t.Fatal("test user not found")
+	}
+
+	user := users.Data[0]
+
+	resp = doRequest(fmt.Sprintf("%s/%d/impersonate", Murl, user.ID), "POST", "", admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	imp := readImpersonationBody(resp)
+
+	if len(imp.Errors) != 0 {
+		t.Fatal(imp.Errors)
+	}
+
+	if imp.Data.Sub != user.ID || imp.Data.Act != admin.Data.ID {
+		t.Fatal("wrong sub or act claim")
+	}
+
+	var claims AccessClaims
+	parts := strings.Split(imp.Data.Token, ".")
+	if len(parts) != 3 {
+		t.Fatal("impersonation token is not a JWT")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(payload, &claims)
+
+	if claims.Act == nil || claims.Act.Sub != fmt.Sprintf("%d", admin.Data.ID) {
+		t.Fatal("act claim missing from the token")
+	}
+
+	if time.Duration(claims.ExpiresAt-claims.IssuedAt)*time.Second != Config.ImpersonationTTL {
+		t.Fatal("impersonation token does not expire after ImpersonationTTL")
+	}
+
+	resp = doRequest(Murl+"/me", "GET", "", imp.Data.Token)
+
+	u.Read(resp)
+
+	if u.Data.Email != "testuser@test.t" {
+		t.Fatal("impersonation token does not act as the user")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/%d/impersonate", Murl, user.ID), "POST", "", imp.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	//the credentials of the user are off limits while impersonating
+	owner := []struct {
+		path string
+		body string
+	}{
+		{"/me/apikeys", `{"name":"persist"}`},
+		{"/me/email", `{"email":"taken@over.t"}`},
+		{"/me/password", `{"currentPassword":"testpass", "password":"new.PASS789", "repassword":"new.PASS789"}`},
+		{"/me/2fa/enroll", ""},
+		{"/me/2fa/confirm", `{"code":"000000"}`},
+		{"/me/2fa/disable", `{"code":"000000"}`},
+		{"/me/2fa/recovery-codes", `{"code":"000000"}`},
+	}
+
+	for _, v := range owner {
+		resp = doRequest(Murl+v.path, "POST", v.body, imp.Data.Token)
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: forbidden expected: %d", v.path, resp.StatusCode)
+		}
+	}
+
+	//"/api/users/audit", ProtectPermission(actionAuditLog, "users.audit")).Methods("GET")
+	resp = doRequest(fmt.Sprintf("%s/audit?actor=%d&user=%d", Murl, admin.Data.ID, user.ID), "GET", "", admin.Data.Token)
+
+	a := readAuditLogsBody(resp)
+
+	if len(a.Errors) != 0 {
+		t.Fatal(a.Errors)
+	}
+
+	audited := false
+	for _, v := range a.Data {
+		if v.Action == "request" && strings.HasSuffix(v.Path, "/users/me") {
+			audited = true
+		}
+	}
+
+	if !audited {
+		t.Fatal("impersonated request not audited")
+	}
+
+	return
+}
@@ -0,0 +1,279 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Invitation lets a new user register without the confirm step,
+// the emailed link already proves the address. Only the hash of the
+// token is stored. An invitation into an organization also creates
+// the membership on registration.
+type Invitation struct {
+	gorm.Model
+	Email          string     `json:"email" gorm:"index;not null" valid:"email,required"`
+	Role           string     `json:"role" valid:"rolename~role: Role not found"`
+	OrganizationID uint       `json:"organizationID"`
+	OrgRole        string     `json:"orgRole" valid:"in(admin|member)"`
+	InvitedBy      uint       `json:"invitedBy"`
+	TokenHash      string     `json:"-" gorm:"index"`
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	AcceptedAt     *time.Time `json:"acceptedAt"`
+	CallBackUrl    string     `json:"callBackUrl" gorm:"-"`
+}
+
+type Invitations []Invitation
+
+type InviteRegister struct {
+	Token      string  `json:"token" valid:"required"`
+	Password   string  `json:"password" valid:"ascii,required"`
+	RePassword string  `json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
+	Profile    Profile `json:"profile"`
+}
+
+// fixed token used when App.IsTest is set
+const testInvitationToken = "testinvitetoken"
+
+func findInvitation(token string) Invitation {
+	var inv Invitation
+	App.DB.Where("token_hash = ? AND accepted_at IS NULL AND expires_at > ?", App.ToSum256(token), time.Now()).
+		Order("id DESC").
+		First(&inv)
+	return inv
+}
+
+// actionInvitationCreate is open to holders of users.create and to organization
+// admins inviting into their organization. Other roles than user need roles.manage.
+func actionInvitationCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data Invitation
+		org  Organization
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			if data.OrganizationID != 0 {
+				App.DB.First(&org, data.OrganizationID)
+			}
+
+			userID := currentUserID(r)
+			global := requestHasPermission(r, "users.create")
+
+			if data.Role == "" {
+				data.Role = "user"
+			}
+			if data.OrganizationID != 0 && data.OrgRole == "" {
+				data.OrgRole = OrgRoleMember
+			}
+			if data.ExpiresAt.IsZero() {
+				data.ExpiresAt = time.Now().Add(Config.InviteTTL)
+			}
+
+			if !global && (data.OrganizationID == 0 || !canAccessOrg(r, data.OrganizationID, true)) {
+				w.WriteHeader(http.StatusForbidden)
+				rsp.Errors.Add("token", "Permission denied")
+			} else if data.OrganizationID != 0 && org.ID == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				rsp.Errors.Add("organizationID", "Organization not found")
+			} else if data.Role != "user" && !canAssignRoles(r) {
+				w.WriteHeader(http.StatusForbidden)
+				rsp.Errors.Add("role", "Permission denied")
+			} else if data.ExpiresAt.Before(time.Now()) {
+				rsp.Errors.Add("expiresAt", "Expiry must be in the future")
+			} else if emailTaken(data.Email, 0) {
+				rsp.Errors.Add("email", "Email not unique")
+			} else if token, err := createInvitation(&data, userID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("email", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.Mail.Send(
+					data.Email,
+					"Invitation",
+					"You are invited to register, go to the link "+data.CallBackUrl+"?invitetoken="+token,
+				)
+				if App.IsTest {
+					log.Println("To register, go to the link " + data.CallBackUrl + "?invitetoken=" + token)
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+// createInvitation replaces the pending invitations of the email into the same
+// organization by the same inviter with a new one
+func createInvitation(inv *Invitation, invitedBy uint) (string, error) {
+	var (
+		token string
+		err   error
+	)
+
+	if App.IsTest {
+		token = testInvitationToken
+	} else {
+		token, err = randomToken(32)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	inv.Model = gorm.Model{}
+	inv.InvitedBy = invitedBy
+	inv.TokenHash = App.ToSum256(token)
+	inv.AcceptedAt = nil
+
+	tx := App.DB.Begin()
+
+	err = tx.Unscoped().
+		Where("email = ? AND organization_id = ? AND invited_by = ? AND accepted_at IS NULL",
+			inv.Email, inv.OrganizationID, invitedBy).
+		Delete(&Invitation{}).Error
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err = tx.Create(inv).Error; err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return token, tx.Commit().Error
+}
+
+func actionInvitationGetAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		invitations Invitations
+		rsp         = core.Response{Data: &invitations, Req: r}
+	)
+
+	App.DB.Where("accepted_at IS NULL AND expires_at > ?", time.Now()).
+		Order("id DESC").
+		Find(&invitations)
+
+	rsp.Data = &invitations
+	rsp.Count = int64(len(invitations))
+
+	w.Write(rsp.Make())
+}
+
+func actionInvitationDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		inv Invitation
+		rsp = core.Response{Data: &inv, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&inv, vars["id"])
+
+	if inv.ID == 0 {
+		rsp.Errors.Add("ID", "Invitation not found")
+	} else if err := App.DB.Unscoped().Delete(&inv).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("ID", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	w.Write(rsp.Make())
+}
+
+// actionRegisterInvite creates an active user straight away and signs them in.
+// It stays open when Config.InviteOnly disables actionRegister.
+func actionRegisterInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		data InviteRegister
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			inv := findInvitation(data.Token)
+
+			if inv.ID == 0 {
+				rsp.Errors.Add("token", "Invitation not found")
+			} else if emailTaken(inv.Email, 0) {
+				rsp.Errors.Add("email", "Email not unique")
+			} else if !checkPasswordPolicy(&rsp, data.Password, User{Email: inv.Email, Profile: data.Profile}) {
+				//checkPasswordPolicy has set the errors
+			} else if passhash, err := hashPassword(data.Password); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("password", "Password hashing error")
+				log.Println("Password hashing error: " + err.Error())
+			} else if err := acceptInvitation(inv, &user, passhash, data.Profile); err != nil {
+				rsp.Errors.Add("token", "Invitation not found")
+				log.Println("Data saving error: " + err.Error())
+			} else if err := genTokens(r, &user, ""); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("token", "Error generating JWT token: "+err.Error())
+			} else {
+				w.Header().Set("Authorization", "Bearer "+user.Token)
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	data.Password = ""
+	data.RePassword = ""
+
+	w.Write(rsp.Make())
+}
+
+// acceptInvitation marks the invitation used and creates the user,
+// the profile and the membership in one transaction
+func acceptInvitation(inv Invitation, user *User, passhash string, profile Profile) error {
+	tx := App.DB.Begin()
+
+	res := tx.Model(&Invitation{}).
+		Where("id = ? AND accepted_at IS NULL", inv.ID).
+		Update("accepted_at", time.Now())
+	if res.Error == nil && res.RowsAffected != 1 {
+		res.Error = gorm.ErrRecordNotFound
+	}
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+
+	profile.Model = gorm.Model{}
+	user.Email = inv.Email
+	user.Password = passhash
+	user.Role = inv.Role
+	user.Status = "active"
+	user.Profile = profile
+
+	if err := tx.Create(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if inv.OrganizationID != 0 {
+		err := tx.Create(&Membership{
+			OrganizationID: inv.OrganizationID,
+			UserID:         user.ID,
+			Role:           inv.OrgRole,
+			Status:         MembershipActive,
+			InvitedBy:      inv.InvitedBy,
+		}).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	recordPassword(user.ID, passhash)
+	return nil
+}
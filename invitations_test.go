@@ -0,0 +1,99 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/icrowley/fake"
+)
+
+//"/api/users/invitations", protectAuth(actionInvitationCreate)).Methods("POST")
+func TestInvitation(t *testing.T) {
+	var u UserData
+	email := fake.EmailAddress()
+
+	admin := loginAdmin(t)
+	user := loginTestUser(t)
+
+	resp := doRequest(Murl+"/invitations", "POST", `{"email":"`+email+`"}`, user.Data.Token)
+
+	if resp.StatusCode != 403 {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/invitations", "POST", `{"email":"testuser@test.t"}`, admin.Data.Token)
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("email unique validation dont work")
+	}
+
+	resp = doRequest(Murl+"/invitations", "POST", `{"email":"`+email+`", "organizationID":999999999}`, admin.Data.Token)
+
+	if resp.StatusCode != 404 {
+		t.Fatalf("Not found expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/invitations", "POST", `{"email":"`+email+`", "role":"user", "callBackUrl":"http://test.ttt"}`, admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	//"/api/users/register/invite", actionRegisterInvite).Methods("POST")
+	resp = doRequest(Murl+"/register/invite", "POST", `{
+		"token":"testinvitetoken",
+		"password":"weak",
+		"repassword":"weak"
+	}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("password complexity validation dont work")
+	}
+
+	resp = doRequest(Murl+"/register/invite", "POST", `{
+		"token":"testinvitetoken",
+		"password":"aaAA11..",
+		"repassword":"aaAA11.."
+	}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Email != email || u.Data.Role != "user" || u.Data.Status != "active" {
+		t.Fatal("invited user not activated")
+	}
+
+	if u.Data.Token == "" {
+		t.Fatal("invited user not signed in")
+	}
+
+	resp = doRequest(Murl+"/register/invite", "POST", `{
+		"token":"testinvitetoken",
+		"password":"aaAA11..",
+		"repassword":"aaAA11.."
+	}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("invitation used twice")
+	}
+
+	return
+}
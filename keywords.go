@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/go-rest-framework/core"
@@ -12,10 +13,17 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+// UserKeyword is a tag for users. Keywords form a tree through ParentID,
+// Slug is generated from the name unless given and is unique.
+// UserCount is only filled by the keyword list.
 type UserKeyword struct {
 	gorm.Model
-	Name        string `json:"name" gorm:"unique"`
-	Description string `json:"description"`
+	Name        string        `json:"name" gorm:"unique"`
+	Slug        string        `json:"slug" gorm:"unique_index"`
+	Description string        `json:"description"`
+	ParentID    *uint         `json:"parentID" gorm:"index"`
+	Children    []UserKeyword `json:"children,omitempty" gorm:"-"`
+	UserCount   int           `json:"userCount" gorm:"-"`
 }
 
 type UserKeywordData struct {
@@ -62,7 +70,20 @@ func actionKeywordCreate(w http.ResponseWriter, r *http.Request) {
 
 	if rsp.IsJsonParseDone(r.Body) {
 		if rsp.IsValidate() {
-			App.DB.Create(&model)
+			var parent UserKeyword
+			if model.ParentID != nil {
+				App.DB.First(&parent, *model.ParentID)
+			}
+
+			if model.ParentID != nil && parent.ID == 0 {
+				rsp.Errors.Add("parentID", "Keyword not found")
+			} else {
+				if model.Slug == "" {
+					model.Slug = model.Name
+				}
+				model.Slug = uniqueKeywordSlug(model.Slug, 0)
+				App.DB.Create(&model)
+			}
 		}
 	}
 
@@ -75,7 +96,7 @@ func actionKeywordUpdate(w http.ResponseWriter, r *http.Request) {
 	var (
 		model UserKeyword
 		data  UserKeyword
-		rsp   = core.Response{Data: &model, Req: r}
+		rsp   = core.Response{Data: &data, Req: r}
 	)
 
 	if rsp.IsJsonParseDone(r.Body) {
@@ -87,6 +108,11 @@ func actionKeywordUpdate(w http.ResponseWriter, r *http.Request) {
 			if model.ID == 0 {
 				rsp.Errors.Add("ID", "Keyword not found")
 			} else {
+				//the parent is only changed by actionKeywordMove, which checks for cycles
+				data.ParentID = nil
+				if data.Slug != "" {
+					data.Slug = uniqueKeywordSlug(data.Slug, model.ID)
+				}
 				App.DB.Model(&model).Updates(data)
 			}
 		}
@@ -97,6 +123,24 @@ func actionKeywordUpdate(w http.ResponseWriter, r *http.Request) {
 	w.Write(rsp.Make())
 }
 
+func actionKeywordGetOne(w http.ResponseWriter, r *http.Request) {
+	var (
+		model UserKeyword
+		rsp   = core.Response{Data: &model, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&model, vars["id"])
+
+	if model.ID == 0 {
+		rsp.Errors.Add("ID", "Keyword not found")
+	}
+
+	rsp.Data = &model
+
+	w.Write(rsp.Make())
+}
+
 func actionKeywordDelete(w http.ResponseWriter, r *http.Request) {
 	var (
 		model UserKeyword
@@ -108,8 +152,12 @@ func actionKeywordDelete(w http.ResponseWriter, r *http.Request) {
 
 	if model.ID == 0 {
 		rsp.Errors.Add("ID", "Keyword not found")
-	} else {
-		App.DB.Unscoped().Delete(&model)
+	} else if len(keywordChildren()[model.ID]) != 0 {
+		rsp.Errors.Add("ID", "Keyword has child keywords, move them first")
+	} else if err := deleteKeyword(model); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("ID", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
 	}
 
 	rsp.Data = &model
@@ -117,6 +165,22 @@ func actionKeywordDelete(w http.ResponseWriter, r *http.Request) {
 	w.Write(rsp.Make())
 }
 
+// deleteKeyword removes the keyword and its links to users in one transaction
+func deleteKeyword(model UserKeyword) error {
+	tx := App.DB.Begin()
+
+	err := tx.Exec("DELETE FROM userkeywords WHERE user_keyword_id = ?", model.ID).Error
+	if err == nil {
+		err = tx.Unscoped().Delete(&model).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
 func actionKeywordGetAll(w http.ResponseWriter, r *http.Request) {
 	var (
 		models []UserKeyword
@@ -144,6 +208,10 @@ func actionKeywordGetAll(w http.ResponseWriter, r *http.Request) {
 			db = db.Order("name")
 		case "-name":
 			db = db.Order("name DESC")
+		case "users":
+			db = db.Order(keywordUsageQuery)
+		case "-users":
+			db = db.Order(keywordUsageQuery + " DESC")
 		}
 	} else {
 		db = db.Order("id DESC")
@@ -162,9 +230,220 @@ func actionKeywordGetAll(w http.ResponseWriter, r *http.Request) {
 	}
 
 	db.Find(&models)
+	countKeywordUsers(models)
 
 	rsp.Data = &models
 	rsp.Count = count
 
 	w.Write(rsp.Make())
 }
+
+const keywordUsageQuery = "(SELECT COUNT(*) FROM userkeywords WHERE userkeywords.user_keyword_id = user_keywords.id)"
+
+// countKeywordUsers sets UserCount, the number of users tagged with each keyword
+func countKeywordUsers(models []UserKeyword) {
+	var (
+		ids  []uint
+		rows []struct {
+			UserKeywordID uint
+			Users         int
+		}
+	)
+
+	for _, m := range models {
+		ids = append(ids, m.ID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	App.DB.Table("userkeywords").
+		Select("user_keyword_id, COUNT(*) AS users").
+		Where("user_keyword_id IN (?)", ids).
+		Group("user_keyword_id").
+		Scan(&rows)
+
+	counts := map[uint]int{}
+	for _, row := range rows {
+		counts[row.UserKeywordID] = row.Users
+	}
+	for i := range models {
+		models[i].UserCount = counts[models[i].ID]
+	}
+}
+
+// KeywordFilter is the keyword=a,b query of the user list, values are
+// keyword ids, names or slugs. A user matches any of them unless All is set,
+// a keyword also matches the users tagged with one of its descendants.
+type KeywordFilter struct {
+	Values []string
+	All    bool
+}
+
+// UserKeywords replaces all keywords of a user
+type UserKeywords struct {
+	Keywords []uint `json:"keywords"`
+}
+
+func parseKeywordFilter(r *http.Request) KeywordFilter {
+	var f KeywordFilter
+
+	seen := map[string]bool{}
+	for _, v := range strings.Split(r.FormValue("keyword"), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			f.Values = append(f.Values, v)
+		}
+	}
+	f.All = r.FormValue("keyword_match") == "all"
+
+	return f
+}
+
+// filterByKeywords narrows the users selected by db to the ones tagged with the keywords
+func filterByKeywords(db *gorm.DB, f KeywordFilter) *gorm.DB {
+	if len(f.Values) == 0 {
+		return db
+	}
+
+	var (
+		children = keywordChildren()
+		matched  []uint
+	)
+
+	for _, v := range f.Values {
+		subtree := keywordSubtree(children, resolveKeyword(v))
+		if !f.All {
+			matched = append(matched, subtree...)
+			continue
+		}
+		db = db.Where("users.id IN (?)", taggedUsers(subtree))
+	}
+
+	if !f.All {
+		db = db.Where("users.id IN (?)", taggedUsers(matched))
+	}
+
+	return db
+}
+
+// taggedUsers selects the ids of the users with any of the keywords
+func taggedUsers(keywords []uint) interface{} {
+	return App.DB.Table("userkeywords").
+		Select("user_id").
+		Where("user_keyword_id IN (?)", keywords).
+		SubQuery()
+}
+
+func findUserAndKeyword(r *http.Request, rsp *core.Response) (User, UserKeyword, bool) {
+	var (
+		user    User
+		keyword UserKeyword
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&user, vars["id"])
+	App.DB.First(&keyword, vars["keywordId"])
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+		return user, keyword, false
+	}
+
+	if keyword.ID == 0 {
+		rsp.Errors.Add("keywordId", "Keyword not found")
+		return user, keyword, false
+	}
+
+	return user, keyword, true
+}
+
+// userWithKeywords is the response of the keyword assignment actions
+func userWithKeywords(id uint) *User {
+	var user User
+	App.DB.Preload("Profile").Preload("Keywords").First(&user, id)
+	user.Password = ""
+	return &user
+}
+
+func actionUserKeywordAdd(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	if user, keyword, ok := findUserAndKeyword(r, &rsp); !ok {
+		//findUserAndKeyword has set the error
+	} else if err := App.DB.Model(&user).Association("Keywords").Append(&keyword).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("keywordId", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	} else {
+		rsp.Data = userWithKeywords(user.ID)
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionUserKeywordDelete(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	if user, keyword, ok := findUserAndKeyword(r, &rsp); !ok {
+		//findUserAndKeyword has set the error
+	} else if err := App.DB.Model(&user).Association("Keywords").Delete(&keyword).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("keywordId", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	} else {
+		rsp.Data = userWithKeywords(user.ID)
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionUserKeywordsReplace(w http.ResponseWriter, r *http.Request) {
+	var (
+		data     UserKeywords
+		user     User
+		keywords []UserKeyword
+		rsp      = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vars := mux.Vars(r)
+			App.DB.First(&user, vars["id"])
+			if len(data.Keywords) != 0 {
+				App.DB.Where("id IN (?)", data.Keywords).Find(&keywords)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("ID", "User not found")
+			} else if len(keywords) != len(uniqueIDs(data.Keywords)) {
+				rsp.Errors.Add("keywords", "Keyword not found")
+			} else if err := App.DB.Model(&user).Association("Keywords").Replace(keywords).Error; err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("keywords", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				rsp.Data = userWithKeywords(user.ID)
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func uniqueIDs(ids []uint) []uint {
+	var (
+		list []uint
+		seen = map[uint]bool{}
+	)
+
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			list = append(list, id)
+		}
+	}
+
+	return list
+}
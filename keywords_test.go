@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/icrowley/fake"
+	"github.com/jinzhu/gorm"
 )
 
 var (
@@ -113,6 +114,22 @@ func Test_actionKeywordUpdate(t *testing.T) {
 	}
 }
 
+func Test_actionKeywordGetOne(t *testing.T) {
+	var data UserKeywordData
+
+	resp := doRequest(Apiurl+"/users/keywords/"+fmt.Sprintf("%d", TestKeywordID), "GET", "", U.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Wrong Response status = %s, want %v", resp.Status, 200)
+	}
+
+	data.Read(resp)
+
+	if data.Data.ID != TestKeywordID {
+		t.Errorf("Keyword not found")
+	}
+}
+
 func Test_actionKeywordGetAll(t *testing.T) {
 	tests := []struct {
 		name string
@@ -124,13 +141,13 @@ func Test_actionKeywordGetAll(t *testing.T) {
 		},
 		{
 			"find from list by name",
-			"&all=" + TestKeywordName,
+			"?all=" + TestKeywordName,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			var data UserKeywordsData
-			iurl := Apiurl + "/users/keywords/" + tt.args
+			iurl := Apiurl + "/users/keywords" + tt.args
 			iproto := "GET"
 
 			resp := doRequest(iurl, iproto, "", U.Data.Token)
@@ -148,6 +165,82 @@ func Test_actionKeywordGetAll(t *testing.T) {
 	}
 }
 
+//"/api/users/{id}/keywords/{keywordId}", actionUserKeywordAdd).Methods("PUT")
+func Test_actionUserKeywords(t *testing.T) {
+	var u UserData
+
+	user := loginTestUser(t)
+	url := fmt.Sprintf("%s/%d/keywords", Murl, user.Data.ID)
+
+	resp := doRequest(fmt.Sprintf("%s/%d", url, TestKeywordID), "PUT", "", U.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data.Keywords) != 1 {
+		t.Fatal("keyword not assigned")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s?keyword=%d,999999999", Murl, TestKeywordID), "GET", "", U.Data.Token)
+
+	listed := func(list TestUsers, id uint) bool {
+		for _, v := range list.Data {
+			if v.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	list := readUsersBody(resp, t)
+
+	//other tests may tag users too, so only the test user and the untagged admin are checked
+	if !listed(list, user.Data.ID) || listed(list, U.Data.ID) {
+		t.Fatal("any keyword filter dont work")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s?keyword=%d,999999999&keyword_match=all", Murl, TestKeywordID), "GET", "", U.Data.Token)
+
+	list = readUsersBody(resp, t)
+
+	if listed(list, user.Data.ID) {
+		t.Fatal("all keywords filter dont work")
+	}
+
+	//"/api/users/{id}/keywords", actionUserKeywordsReplace).Methods("PUT")
+	resp = doRequest(url, "PUT", `{"keywords":[999999999]}`, U.Data.Token)
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("unknown keyword accepted")
+	}
+
+	//"/api/users/{id}/keywords/{keywordId}", actionUserKeywordDelete).Methods("DELETE")
+	resp = doRequest(fmt.Sprintf("%s/%d", url, TestKeywordID), "DELETE", "", U.Data.Token)
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data.Keywords) != 0 {
+		t.Fatal("keyword not removed")
+	}
+
+	return
+}
+
 func Test_actionKeywordDelete(t *testing.T) {
 	tests := []struct {
 		name string
@@ -172,3 +265,158 @@ func Test_actionKeywordDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Go", "go"},
+		{"  Machine Learning ", "machine-learning"},
+		{"C++ / C#", "c-c"},
+		{"Über Äpfel", "über-äpfel"},
+		{"!!!", "keyword"},
+	}
+
+	for _, tt := range tests {
+		if got := slugify(tt.in); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestKeywordTree(t *testing.T) {
+	one, two := uint(1), uint(2)
+	tree := keywordTree([]UserKeyword{
+		{Model: gorm.Model{ID: 1}, Name: "lang"},
+		{Model: gorm.Model{ID: 2}, Name: "go", ParentID: &one},
+		{Model: gorm.Model{ID: 3}, Name: "generics", ParentID: &two},
+		{Model: gorm.Model{ID: 4}, Name: "misc"},
+	})
+
+	if len(tree) != 2 || len(tree[0].Children) != 1 || len(tree[0].Children[0].Children) != 1 {
+		t.Fatalf("wrong tree: %+v", tree)
+	}
+
+	children := map[uint][]uint{0: {1, 4}, 1: {2}, 2: {3}}
+
+	if got := keywordSubtree(children, []uint{1}); len(got) != 3 {
+		t.Fatalf("subtree of 1 = %v, want 3 ids", got)
+	}
+}
+
+//"/api/users/keywords/{id}/move", actionKeywordMove).Methods("POST")
+func Test_actionKeywordMove(t *testing.T) {
+	var parent, child, data UserKeywordData
+
+	resp := doRequest(Apiurl+"/users/keywords", "POST", `{"name":"`+fake.Words()+`"}`, U.Data.Token)
+	parent.Read(resp)
+
+	resp = doRequest(Apiurl+"/users/keywords", "POST", fmt.Sprintf(`{"name":"%s", "parentID":%d}`, fake.Words(), parent.Data.ID), U.Data.Token)
+	child.Read(resp)
+
+	if child.Data.ParentID == nil || *child.Data.ParentID != parent.Data.ID {
+		t.Fatal("parent not set")
+	}
+
+	if child.Data.Slug == "" {
+		t.Fatal("slug not generated")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/users/keywords/%d/move", Apiurl, parent.Data.ID), "POST", fmt.Sprintf(`{"parentID":%d}`, child.Data.ID), U.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	data.Read(resp)
+
+	if len(data.Errors) == 0 {
+		t.Fatal("cycle not detected")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/users/keywords/%d", Apiurl, parent.Data.ID), "DELETE", "", U.Data.Token)
+
+	data = UserKeywordData{}
+	data.Read(resp)
+
+	if len(data.Errors) == 0 {
+		t.Fatal("keyword with children deleted")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/users/keywords/%d/move", Apiurl, child.Data.ID), "POST", `{"parentID":null}`, U.Data.Token)
+
+	data = UserKeywordData{}
+	data.Read(resp)
+
+	if len(data.Errors) != 0 || data.Data.ParentID != nil {
+		t.Fatal("keyword not moved to the top level")
+	}
+
+	doRequest(fmt.Sprintf("%s/users/keywords/%d", Apiurl, child.Data.ID), "DELETE", "", U.Data.Token)
+	doRequest(fmt.Sprintf("%s/users/keywords/%d", Apiurl, parent.Data.ID), "DELETE", "", U.Data.Token)
+
+	return
+}
+
+//"/api/users/keywords/{id}/merge", actionKeywordMerge).Methods("POST")
+func Test_actionKeywordMerge(t *testing.T) {
+	var source, target, data UserKeywordData
+	var u UserData
+
+	user := loginTestUser(t)
+
+	resp := doRequest(Apiurl+"/users/keywords", "POST", `{"name":"`+fake.Words()+`"}`, U.Data.Token)
+	source.Read(resp)
+
+	resp = doRequest(Apiurl+"/users/keywords", "POST", `{"name":"`+fake.Words()+`"}`, U.Data.Token)
+	target.Read(resp)
+
+	doRequest(fmt.Sprintf("%s/%d/keywords/%d", Murl, user.Data.ID, source.Data.ID), "PUT", "", U.Data.Token)
+
+	url := fmt.Sprintf("%s/users/keywords/%d/merge", Apiurl, source.Data.ID)
+
+	resp = doRequest(url, "POST", fmt.Sprintf(`{"targetID":%d}`, source.Data.ID), U.Data.Token)
+	data.Read(resp)
+
+	if len(data.Errors) == 0 {
+		t.Fatal("keyword merged into itself")
+	}
+
+	resp = doRequest(url, "POST", fmt.Sprintf(`{"targetID":%d}`, target.Data.ID), U.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	data = UserKeywordData{}
+	data.Read(resp)
+
+	if len(data.Errors) != 0 {
+		t.Fatal(data.Errors)
+	}
+
+	if data.Data.UserCount != 1 {
+		t.Fatalf("target has %d users, want 1", data.Data.UserCount)
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/%d", Murl, user.Data.ID), "GET", "", U.Data.Token)
+	u.Read(resp)
+
+	if len(u.Data.Keywords) != 1 || u.Data.Keywords[0].ID != target.Data.ID {
+		t.Fatal("user not moved to the target keyword")
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/users/keywords/%d", Apiurl, source.Data.ID), "GET", "", U.Data.Token)
+
+	data = UserKeywordData{}
+	data.Read(resp)
+
+	if len(data.Errors) == 0 {
+		t.Fatal("source keyword not deleted")
+	}
+
+	doRequest(fmt.Sprintf("%s/%d/keywords", Murl, user.Data.ID), "PUT", `{"keywords":[]}`, U.Data.Token)
+	doRequest(fmt.Sprintf("%s/users/keywords/%d", Apiurl, target.Data.ID), "DELETE", "", U.Data.Token)
+
+	return
+}
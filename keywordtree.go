@@ -0,0 +1,276 @@
+package users
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+)
+
+// KeywordMove sets the parent of a keyword, null moves it to the top level
+type KeywordMove struct {
+	ParentID *uint `json:"parentID"`
+}
+
+// slugify keeps letters and digits and joins the rest with dashes
+func slugify(s string) string {
+	var (
+		b    strings.Builder
+		dash bool
+	)
+
+	for _, c := range strings.ToLower(s) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+
+	if b.Len() == 0 {
+		return "keyword"
+	}
+	return b.String()
+}
+
+// uniqueKeywordSlug numbers the slug until no other keyword has it
+func uniqueKeywordSlug(s string, id uint) string {
+	base := slugify(s)
+	slug := base
+
+	for i := 2; ; i++ {
+		var count int
+		App.DB.Unscoped().Model(&UserKeyword{}).Where("slug = ? AND id <> ?", slug, id).Count(&count)
+		if count == 0 {
+			return slug
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// migrateKeywordSlugs gives the keywords created before slugs one
+func migrateKeywordSlugs() {
+	var keywords []UserKeyword
+	App.DB.Where("slug IS NULL OR slug = ''").Find(&keywords)
+
+	for _, k := range keywords {
+		err := App.DB.Model(&k).UpdateColumn("slug", uniqueKeywordSlug(k.Name, k.ID)).Error
+		if err != nil {
+			log.Println("Data saving error: " + err.Error())
+		}
+	}
+}
+
+// keywordChildren maps every keyword id to the ids of its children, 0 holds the top level
+func keywordChildren() map[uint][]uint {
+	var keywords []UserKeyword
+	App.DB.Select("id, parent_id").Find(&keywords)
+
+	children := map[uint][]uint{}
+	for _, k := range keywords {
+		var parent uint
+		if k.ParentID != nil {
+			parent = *k.ParentID
+		}
+		children[parent] = append(children[parent], k.ID)
+	}
+
+	return children
+}
+
+// keywordSubtree returns the ids and all their descendants
+func keywordSubtree(children map[uint][]uint, ids []uint) []uint {
+	var (
+		subtree []uint
+		seen    = map[uint]bool{}
+	)
+
+	for len(ids) != 0 {
+		id := ids[0]
+		ids = ids[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		subtree = append(subtree, id)
+		ids = append(ids, children[id]...)
+	}
+
+	return subtree
+}
+
+// resolveKeyword finds keywords by id, name or slug
+func resolveKeyword(value string) []uint {
+	var ids []uint
+
+	db := App.DB.Model(&UserKeyword{})
+	if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+		db = db.Where("id = ? OR name = ? OR slug = ?", id, value, value)
+	} else {
+		db = db.Where("name = ? OR slug = ?", value, value)
+	}
+	db.Pluck("id", &ids)
+
+	return ids
+}
+
+// keywordCycle reports whether putting the keyword under parent would make it its own ancestor
+func keywordCycle(id, parent uint) bool {
+	for _, d := range keywordSubtree(keywordChildren(), []uint{id}) {
+		if d == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// keywordTree nests the keywords under their parents
+func keywordTree(keywords []UserKeyword) []UserKeyword {
+	byParent := map[uint][]UserKeyword{}
+	for _, k := range keywords {
+		var parent uint
+		if k.ParentID != nil {
+			parent = *k.ParentID
+		}
+		byParent[parent] = append(byParent[parent], k)
+	}
+
+	var build func(parent uint) []UserKeyword
+	build = func(parent uint) []UserKeyword {
+		nodes := byParent[parent]
+		for i := range nodes {
+			nodes[i].Children = build(nodes[i].ID)
+		}
+		return nodes
+	}
+
+	return build(0)
+}
+
+func actionKeywordTree(w http.ResponseWriter, r *http.Request) {
+	var (
+		keywords []UserKeyword
+		rsp      = core.Response{Data: &keywords, Req: r}
+	)
+
+	App.DB.Order("name").Find(&keywords)
+
+	tree := keywordTree(keywords)
+	rsp.Data = &tree
+	rsp.Count = int64(len(keywords))
+
+	w.Write(rsp.Make())
+}
+
+func actionKeywordMove(w http.ResponseWriter, r *http.Request) {
+	var (
+		data   KeywordMove
+		model  UserKeyword
+		parent UserKeyword
+		rsp    = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vars := mux.Vars(r)
+			App.DB.First(&model, vars["id"])
+			if data.ParentID != nil {
+				App.DB.First(&parent, *data.ParentID)
+			}
+
+			if model.ID == 0 {
+				rsp.Errors.Add("ID", "Keyword not found")
+			} else if data.ParentID != nil && parent.ID == 0 {
+				rsp.Errors.Add("parentID", "Keyword not found")
+			} else if data.ParentID != nil && keywordCycle(model.ID, parent.ID) {
+				rsp.Errors.Add("parentID", "Keyword can not be moved under itself or its descendants")
+			} else if err := App.DB.Model(&model).Update("parent_id", data.ParentID).Error; err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("parentID", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				model.ParentID = data.ParentID
+				rsp.Data = &model
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+// KeywordMerge names the keyword that takes over the users of the merged one
+type KeywordMerge struct {
+	TargetID uint `json:"targetID" valid:"required"`
+}
+
+// mergeKeyword moves the users and the child keywords of source to target
+// and deletes source, in one transaction
+func mergeKeyword(source, target UserKeyword) error {
+	tx := App.DB.Begin()
+
+	//users tagged with both keep the target only, the derived table lets MySQL read the table it deletes from
+	err := tx.Exec(`DELETE FROM userkeywords WHERE user_keyword_id = ? AND user_id IN (
+		SELECT user_id FROM (SELECT user_id FROM userkeywords WHERE user_keyword_id = ?) AS tagged)`,
+		source.ID, target.ID).Error
+	if err == nil {
+		err = tx.Exec("UPDATE userkeywords SET user_keyword_id = ? WHERE user_keyword_id = ?", target.ID, source.ID).Error
+	}
+	if err == nil {
+		err = tx.Model(&UserKeyword{}).Where("parent_id = ?", source.ID).Update("parent_id", target.ID).Error
+	}
+	if err == nil {
+		err = tx.Unscoped().Delete(&source).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func actionKeywordMerge(w http.ResponseWriter, r *http.Request) {
+	var (
+		data   KeywordMerge
+		source UserKeyword
+		target UserKeyword
+		rsp    = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vars := mux.Vars(r)
+			App.DB.First(&source, vars["id"])
+			App.DB.First(&target, data.TargetID)
+
+			if source.ID == 0 {
+				rsp.Errors.Add("ID", "Keyword not found")
+			} else if target.ID == 0 {
+				rsp.Errors.Add("targetID", "Keyword not found")
+			} else if keywordCycle(source.ID, target.ID) {
+				//covers source == target, the children of source can not move below themselves
+				rsp.Errors.Add("targetID", "Keyword can not be merged into itself or its descendants")
+			} else if err := mergeKeyword(source, target); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("targetID", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.DB.First(&target, target.ID)
+				models := []UserKeyword{target}
+				countKeywordUsers(models)
+				rsp.Data = &models[0]
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
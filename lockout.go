@@ -0,0 +1,340 @@
+package users
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// LoginAttempt counts the failed logins of one email or one client IP
+type LoginAttempt struct {
+	gorm.Model
+	Key           string `gorm:"column:lock_key;unique;not null"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time `gorm:"index"`
+}
+
+// LockStore keeps the failed login counters, see DBLockStore and MemoryLockStore
+type LockStore interface {
+	Get(key string) LoginAttempt
+	// Update runs change on the counter of the key and saves it when change
+	// returns true. Updates of one key are serialized, also between nodes for DBLockStore.
+	Update(key string, change func(a *LoginAttempt) bool) error
+	Delete(key string) error
+	// Purge drops unlocked counters without failures since before
+	Purge(before time.Time)
+}
+
+type LoginUnlock struct {
+	Token string `json:"token" valid:"required"`
+}
+
+var loginLocks LockStore
+
+// DBLockStore shares the counters between nodes through the database
+type DBLockStore struct{}
+
+func (DBLockStore) Get(key string) LoginAttempt {
+	var a LoginAttempt
+	App.DB.Where("lock_key = ?", key).First(&a)
+	a.Key = key
+	return a
+}
+
+func (DBLockStore) Update(key string, change func(a *LoginAttempt) bool) error {
+	var a LoginAttempt
+
+	//the row has to exist to be locked, losing a concurrent insert of it is fine
+	App.DB.Where(LoginAttempt{Key: key}).FirstOrCreate(&LoginAttempt{})
+
+	tx := App.DB.Begin()
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("lock_key = ?", key).First(&a).Error
+	if err == nil && change(&a) {
+		err = tx.Save(&a).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (DBLockStore) Delete(key string) error {
+	return App.DB.Unscoped().Where("lock_key = ?", key).Delete(&LoginAttempt{}).Error
+}
+
+func (DBLockStore) Purge(before time.Time) {
+	App.DB.Unscoped().
+		Where("last_failure_at < ? AND locked_until < ?", before, time.Now()).
+		Delete(&LoginAttempt{})
+}
+
+// MemoryLockStore keeps the counters in process, for single node deployments
+type MemoryLockStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+func NewMemoryLockStore() *MemoryLockStore {
+	return &MemoryLockStore{attempts: map[string]LoginAttempt{}}
+}
+
+func (s *MemoryLockStore) Get(key string) LoginAttempt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.attempts[key]
+	a.Key = key
+	return a
+}
+
+func (s *MemoryLockStore) Update(key string, change func(a *LoginAttempt) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.attempts[key]
+	a.Key = key
+	if change(&a) {
+		s.attempts[key] = a
+	}
+	return nil
+}
+
+func (s *MemoryLockStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryLockStore) Purge(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, a := range s.attempts {
+		if a.LastFailureAt.Before(before) && a.LockedUntil.Before(now) {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+func newLockStore(kind string) LockStore {
+	if kind == "memory" {
+		return NewMemoryLockStore()
+	}
+	return DBLockStore{}
+}
+
+func emailLockKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipLockKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginBackoff is the wait after the last failure, it doubles with every
+// failure past the threshold and stops growing at Config.LoginBackoffMax
+func loginBackoff(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	delay := Config.LoginBackoffBase
+	for i := threshold; i < failures && delay < Config.LoginBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > Config.LoginBackoffMax {
+		delay = Config.LoginBackoffMax
+	}
+	return delay
+}
+
+// loginRetryAfter tells how long the key has to wait before the next attempt
+func loginRetryAfter(a LoginAttempt, threshold int, now time.Time) time.Duration {
+	wait := a.LastFailureAt.Add(loginBackoff(a.Failures, threshold)).Sub(now)
+	if locked := a.LockedUntil.Sub(now); locked > wait {
+		wait = locked
+	}
+	return wait
+}
+
+// reserveLoginAttempt counts the attempt as a failure before the password is
+// checked, unless the key has to wait. Parallel guesses are reserved one by one,
+// so they can not all pass before the first failure is counted.
+// It returns the wait, 0 when the attempt is reserved.
+func reserveLoginAttempt(key string, threshold int, now time.Time) time.Duration {
+	var wait time.Duration
+
+	err := loginLocks.Update(key, func(a *LoginAttempt) bool {
+		if wait = loginRetryAfter(*a, threshold, now); wait > 0 {
+			return false
+		}
+		wait = 0
+		if now.Sub(a.LastFailureAt) > Config.LoginAttemptWindow {
+			a.Failures = 0
+		}
+		a.Failures++
+		a.LastFailureAt = now
+		return true
+	})
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	return wait
+}
+
+// releaseLoginAttempt takes back a reserved attempt that turned out right
+func releaseLoginAttempt(key string) {
+	err := loginLocks.Update(key, func(a *LoginAttempt) bool {
+		if a.Failures == 0 {
+			return false
+		}
+		a.Failures--
+		return true
+	})
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+}
+
+// loginFailed keeps the reserved attempt as a failure and reports whether
+// it locked the key, lockAfter 0 never locks
+func loginFailed(key string, lockAfter int, now time.Time) bool {
+	locked := false
+
+	err := loginLocks.Update(key, func(a *LoginAttempt) bool {
+		if lockAfter <= 0 || a.Failures < lockAfter || a.LockedUntil.After(now) {
+			return false
+		}
+		a.LockedUntil = now.Add(Config.LockoutDuration)
+		locked = true
+		return true
+	})
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	return locked
+}
+
+func unlockLogin(email string) {
+	if err := loginLocks.Delete(emailLockKey(email)); err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+}
+
+// checkLoginLocks reserves an attempt for the email and the client IP, or answers 429
+// when either has to wait. Every reserved attempt ends in recordLoginFailure or releaseLoginLocks.
+func checkLoginLocks(w http.ResponseWriter, rsp *core.Response, r *http.Request, email string) bool {
+	now := time.Now()
+	ipKey := ipLockKey(clientIP(r))
+
+	wait := reserveLoginAttempt(ipKey, Config.LoginBackoffAfterIP, now)
+	if wait <= 0 {
+		if wait = reserveLoginAttempt(emailLockKey(email), Config.LoginBackoffAfter, now); wait > 0 {
+			releaseLoginAttempt(ipKey)
+		}
+	}
+
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	rsp.Errors.Add("email", fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds))
+	return false
+}
+
+// releaseLoginLocks takes back the attempts reserved by checkLoginLocks
+// once the password or code is right
+func releaseLoginLocks(r *http.Request, email string) {
+	releaseLoginAttempt(ipLockKey(clientIP(r)))
+	releaseLoginAttempt(emailLockKey(email))
+}
+
+// recordLoginFailure keeps the attempts reserved by checkLoginLocks as failures,
+// and mails an unlock link when the account gets locked
+func recordLoginFailure(r *http.Request, user User, email string) {
+	now := time.Now()
+
+	loginFailed(ipLockKey(clientIP(r)), 0, now)
+
+	if !loginFailed(emailLockKey(email), Config.LockoutThreshold, now) || user.ID == 0 {
+		return
+	}
+
+	token, err := issueVerificationToken(user.ID, PurposeUnlock, "")
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+		return
+	}
+
+	App.Mail.Send(
+		user.Email,
+		"Account locked",
+		"Your account was locked after too many failed sign in attempts. To unlock it, go to the link "+
+			Config.UnlockCallBackUrl+"?unlocktoken="+token,
+	)
+	if App.IsTest {
+		log.Println("To unlock the account, go to the link " + Config.UnlockCallBackUrl + "?unlocktoken=" + token)
+	}
+}
+
+func actionUnlock(w http.ResponseWriter, r *http.Request) {
+	var (
+		data LoginUnlock
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			token, ok := useVerificationToken(data.Token, PurposeUnlock)
+			if ok {
+				App.DB.First(&user, token.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("token", "User not found")
+			} else {
+				unlockLogin(user.Email)
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionUserUnlock(w http.ResponseWriter, r *http.Request) {
+	var (
+		user User
+		rsp  = core.Response{Data: &user, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&user, vars["id"])
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else {
+		unlockLogin(user.Email)
+		user.Password = ""
+	}
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,142 @@
+package users
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icrowley/fake"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{40, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failures, 3); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryLockStore(t *testing.T) {
+	saved := loginLocks
+	loginLocks = NewMemoryLockStore()
+	defer func() { loginLocks = saved }()
+
+	key := emailLockKey("Locked@Test.t")
+	threshold := Config.LockoutThreshold + 1
+
+	for i := 1; i < Config.LockoutThreshold; i++ {
+		if reserveLoginAttempt(key, threshold, time.Now()) > 0 {
+			t.Fatalf("attempt %d not reserved", i)
+		}
+		if loginFailed(key, Config.LockoutThreshold, time.Now()) {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+
+	reserveLoginAttempt(key, threshold, time.Now())
+	if !loginFailed(key, Config.LockoutThreshold, time.Now()) {
+		t.Fatal("not locked after the threshold")
+	}
+
+	a := loginLocks.Get(emailLockKey("locked@test.t"))
+
+	if loginRetryAfter(a, threshold, time.Now()) < Config.LockoutDuration-time.Minute {
+		t.Fatal("lock does not last LockoutDuration")
+	}
+
+	if reserveLoginAttempt(key, threshold, time.Now()) == 0 {
+		t.Fatal("attempt reserved while locked")
+	}
+
+	unlockLogin("locked@test.t")
+
+	if loginLocks.Get(key).Failures != 0 {
+		t.Fatal("unlock does not reset the counter")
+	}
+
+	reserveLoginAttempt(key, threshold, time.Now())
+	releaseLoginAttempt(key)
+
+	if loginLocks.Get(key).Failures != 0 {
+		t.Fatal("release does not take the attempt back")
+	}
+}
+
+func TestMemoryLockStoreConcurrent(t *testing.T) {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		reserved int
+	)
+
+	saved := loginLocks
+	loginLocks = NewMemoryLockStore()
+	defer func() { loginLocks = saved }()
+
+	key := emailLockKey("concurrent@test.t")
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveLoginAttempt(key, 3, time.Now()) == 0 {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 3 {
+		t.Errorf("Expected 3 reserved attempts, got %d", reserved)
+	}
+
+	if a := loginLocks.Get(key); a.Failures != 3 {
+		t.Errorf("Expected 3 failures, got %d", a.Failures)
+	}
+}
+
+//"/api/users/login", actionLogin).Methods("POST")
+func TestLoginLockout(t *testing.T) {
+	var u UserData
+	email := fake.EmailAddress()
+
+	for i := 0; i < Config.LoginBackoffAfter; i++ {
+		resp := doRequest(Murl+"/login", "POST", `{"email":"`+email+`", "password":"wrongpass"}`, "")
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("Success expected: %d", resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(Murl+"/login", "POST", `{"email":"`+email+`", "password":"wrongpass"}`, "")
+
+	if resp.StatusCode != 429 {
+		t.Fatalf("Too many requests expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("no error on backoff")
+	}
+
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatal("Retry-After not set")
+	}
+
+	return
+}
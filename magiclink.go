@@ -0,0 +1,111 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-rest-framework/core"
+)
+
+type MagicLinkRequest struct {
+	Email       string `json:"email" valid:"email,required"`
+	CallBackUrl string `json:"callBackUrl"`
+}
+
+type MagicLinkVerify struct {
+	Token string `json:"token" valid:"required"`
+}
+
+func actionMagicLink(w http.ResponseWriter, r *http.Request) {
+	var (
+		data MagicLinkRequest
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			if !magicByIP.Allow(clientIP(r)) || !magicByEmail.Allow(strings.ToLower(data.Email)) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				rsp.Errors.Add("email", "Too many requests, try again later")
+			} else {
+				App.DB.Where("email = ?", data.Email).First(&user)
+				if user.ID == 0 {
+					rsp.Errors.Add("email", "User not found")
+				} else if user.Role == "" || user.Role == "candidate" {
+					rsp.Errors.Add("email", "You have not confirmed your email")
+				} else {
+					token, err := issueVerificationToken(user.ID, PurposeMagicLink, "")
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						rsp.Errors.Add("email", "Data saving error")
+						log.Println("Data saving error: " + err.Error())
+					} else {
+						App.Mail.Send(
+							user.Email,
+							"Sign in link",
+							"To sign in, go to the link "+data.CallBackUrl+"?magictoken="+token,
+						)
+						if App.IsTest {
+							log.Println("To sign in, go to the link " + data.CallBackUrl + "?magictoken=" + token)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
+
+func actionMagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      MagicLinkVerify
+		user      User
+		challenge LoginChallenge
+		expired   PasswordExpired
+		rsp       = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			link, ok := useVerificationToken(data.Token, PurposeMagicLink)
+			if ok {
+				App.DB.Preload("Profile").First(&user, link.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("token", "Sign in link is not valid or has expired")
+			} else if twoFactorEnabled(user.ID) {
+				//an expired password is handled after the second factor
+				token, err := startMFAChallenge(user.ID)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("token", "Error generating challenge token: "+err.Error())
+				} else {
+					challenge.MFARequired = true
+					challenge.ChallengeToken = token
+					rsp.Data = &challenge
+				}
+			} else if passwordExpired(user) {
+				expired = expiredPasswordChange(w, &rsp, user)
+			} else if err := genTokens(r, &user, ""); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("token", "Error generating JWT token: "+err.Error())
+			} else {
+				w.Header().Set("Authorization", "Bearer "+user.Token)
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	if expired.PasswordExpired {
+		rsp.Data = &expired
+	}
+
+	w.Write(rsp.Make())
+}
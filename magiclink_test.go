@@ -0,0 +1,104 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/icrowley/fake"
+)
+
+//"/api/users/magiclink", actionMagicLink).Methods("POST")
+func TestMagicLink(t *testing.T) {
+	var u UserData
+	url := Murl + "/magiclink"
+
+	resp := doRequest(url, "POST", `{"email":"nobody@nowhere.n", "callBackUrl":"http://test.ttt"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("magic link sent to unknown email")
+	}
+
+	resp = doRequest(url, "POST", `{"email":"testuser@test.t", "callBackUrl":"http://test.ttt"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	return
+}
+
+//"/api/users/magiclink", actionMagicLink).Methods("POST")
+func TestMagicLinkThrottle(t *testing.T) {
+	url := Murl + "/magiclink"
+	body := `{"email":"` + fake.EmailAddress() + `", "callBackUrl":"http://test.ttt"}`
+
+	for i := 0; i < Config.ResendPerEmail; i++ {
+		resp := doRequest(url, "POST", body, "")
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("Success expected: %d", resp.StatusCode)
+		}
+	}
+
+	resp := doRequest(url, "POST", body, "")
+
+	if resp.StatusCode != 429 {
+		t.Fatalf("Too many requests expected: %d", resp.StatusCode)
+	}
+
+	return
+}
+
+//"/api/users/magiclink/verify", actionMagicLinkVerify).Methods("POST")
+func TestMagicLinkVerify(t *testing.T) {
+	var u UserData
+	url := Murl + "/magiclink/verify"
+
+	resp := doRequest(url, "POST", `{"token":"wrongtoken"}`, "")
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("wrong magic token accepted")
+	}
+
+	resp = doRequest(url, "POST", `{"token":"testmagictoken"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Token == "" || u.Data.Email != "testuser@test.t" {
+		t.Fatal("no token after magic link sign in")
+	}
+
+	resp = doRequest(url, "POST", `{"token":"testmagictoken"}`, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("magic link used twice")
+	}
+
+	return
+}
@@ -0,0 +1,174 @@
+package users
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+type MeUpdate struct {
+	Profile Profile `json:"profile"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"currentPassword" valid:"required"`
+	Password        string `json:"password" valid:"ascii,required"`
+	RePassword      string `json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
+}
+
+// currentUserID returns the id of the user the access token was issued to
+func currentUserID(r *http.Request) uint {
+	session, ok := currentSession(r)
+	if !ok {
+		return 0
+	}
+	return session.UserID
+}
+
+// updateProfile saves the non-empty profile fields, creating the profile if the user has none
+func updateProfile(user *User, data Profile) error {
+	data.Model = gorm.Model{}
+
+	if user.ProfileID == 0 {
+		if err := App.DB.Create(&data).Error; err != nil {
+			return err
+		}
+		user.Profile = data
+		return App.DB.Model(user).Update("profile_id", data.ID).Error
+	}
+
+	return App.DB.Model(&user.Profile).Updates(data).Error
+}
+
+func actionMeGet(w http.ResponseWriter, r *http.Request) {
+	var (
+		user User
+		rsp  = core.Response{Data: &user, Req: r}
+	)
+
+	App.DB.Preload("Profile").First(&user, currentUserID(r))
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	}
+
+	user.Password = ""
+	rsp.Data = &user
+
+	w.Write(rsp.Make())
+}
+
+func actionMeUpdate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data MeUpdate
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			App.DB.Preload("Profile").First(&user, currentUserID(r))
+
+			if user.ID == 0 {
+				rsp.Errors.Add("ID", "User not found")
+			} else if err := updateProfile(&user, data.Profile); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("profile", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.DB.Preload("Profile").First(&user, user.ID)
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionMeProfileUpdate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data Profile
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			App.DB.Preload("Profile").First(&user, currentUserID(r))
+
+			if user.ID == 0 {
+				rsp.Errors.Add("ID", "User not found")
+			} else if err := updateProfile(&user, data); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("profile", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.DB.First(&user.Profile, user.ProfileID)
+				rsp.Data = &user.Profile
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionMePassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		data PasswordChange
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			session, _ := currentSession(r)
+			App.DB.Preload("Profile").First(&user, session.UserID)
+
+			if user.ID == 0 {
+				rsp.Errors.Add("ID", "User not found")
+			} else if !checkLoginLocks(w, &rsp, r, user.Email) {
+				//checkLoginLocks has set the error
+			} else if !checkPassword(user, data.CurrentPassword) {
+				//guesses of the current password count towards the lockout like wrong sign ins
+				recordLoginFailure(r, user, user.Email)
+				rsp.Errors.Add("currentPassword", "Wrong password")
+			} else {
+				releaseLoginLocks(r, user.Email)
+
+				if !checkPasswordPolicy(&rsp, data.Password, user) {
+					//checkPasswordPolicy has set the errors
+				} else if passwordReused(user, data.Password) {
+					rsp.Errors.Add("password", "Password was used recently")
+				} else if passhash, err := hashPassword(data.Password); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("password", "Password hashing error")
+					log.Println("Password hashing error: " + err.Error())
+				} else {
+					res := App.DB.Model(&user).Updates(map[string]interface{}{
+						"password":    passhash,
+						"salt":        "",
+						"legacy_hash": false,
+					})
+					if res.Error != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						rsp.Errors.Add("password", "Data saving error")
+						log.Println("Data saving error: " + res.Error.Error())
+					} else {
+						recordPassword(user.ID, passhash)
+						revokeOtherTokens(user.ID, session.Family)
+					}
+				}
+			}
+		}
+	}
+
+	data.CurrentPassword = ""
+	data.Password = ""
+	data.RePassword = ""
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,123 @@
+package users
+
+import (
+	"testing"
+
+	"github.com/icrowley/fake"
+)
+
+func loginTestUser(t *testing.T) UserData {
+	var u UserData
+
+	resp := doRequest(Murl+"/login", "POST", `{"email":"testuser@test.t", "password":"testpass"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	return u
+}
+
+//"/api/users/me", protectAuth(actionMeGet)).Methods("GET")
+func TestMeGet(t *testing.T) {
+	var u UserData
+
+	login := loginTestUser(t)
+
+	resp := doRequest(Murl+"/me", "GET", "", login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Email != "testuser@test.t" {
+		t.Fatal("wrong user returned")
+	}
+
+	if u.Data.Password != "" {
+		t.Fatal("password hash returned")
+	}
+
+	return
+}
+
+//"/api/users/me/profile", protectAuth(actionMeProfileUpdate)).Methods("PATCH")
+func TestMeProfileUpdate(t *testing.T) {
+	var p TestProfile
+	var u UserData
+	firstname := fake.FirstName()
+
+	login := loginTestUser(t)
+
+	resp := doRequest(Murl+"/me/profile", "PATCH", `{"firstname":"`+firstname+`"}`, login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	p = readProfileBody(resp, t)
+
+	if len(p.Errors) != 0 {
+		t.Fatal(p.Errors)
+	}
+
+	resp = doRequest(Murl+"/me", "GET", "", login.Data.Token)
+
+	u.Read(resp)
+
+	if u.Data.Profile.Firstname != firstname {
+		t.Fatal("profile not updated")
+	}
+
+	return
+}
+
+//"/api/users/me/password", protectAuth(actionMePassword)).Methods("POST")
+func TestMePassword(t *testing.T) {
+	var u UserData
+
+	login := loginTestUser(t)
+
+	resp := doRequest(Murl+"/me/password", "POST", `{
+		"currentPassword":"wrongpass",
+		"password":"good.PASS123",
+		"repassword":"good.PASS123"
+	}`, login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("password changed without current password")
+	}
+
+	resp = doRequest(Murl+"/me/password", "POST", `{
+		"currentPassword":"testpass",
+		"password":"weak",
+		"repassword":"weak"
+	}`, login.Data.Token)
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("password complexity validation dont work")
+	}
+
+	return
+}
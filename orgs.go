@@ -0,0 +1,377 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+
+	MembershipInvited = "invited"
+	MembershipActive  = "active"
+)
+
+type Organization struct {
+	gorm.Model
+	Name        string `json:"name" gorm:"not null" valid:"required"`
+	Description string `json:"description"`
+}
+
+type Organizations []Organization
+
+// Membership links a user to an organization with a role
+// that only applies inside that organization
+type Membership struct {
+	gorm.Model
+	OrganizationID uint   `json:"organizationID" gorm:"unique_index:idx_membership"`
+	UserID         uint   `json:"userID" gorm:"unique_index:idx_membership"`
+	Role           string `json:"role"`
+	Status         string `json:"status"`
+	InvitedBy      uint   `json:"invitedBy"`
+}
+
+type MemberInvite struct {
+	Email       string `json:"email" valid:"email,required"`
+	Role        string `json:"role" valid:"required,in(admin|member)"`
+	CallBackUrl string `json:"callBackUrl"`
+}
+
+type MemberUpdate struct {
+	Role string `json:"role" valid:"required,in(admin|member)"`
+}
+
+type InvitationAccept struct {
+	Token string `json:"token" valid:"required"`
+}
+
+func findMembership(orgID, userID uint) Membership {
+	var m Membership
+	App.DB.Where("organization_id = ? AND user_id = ?", orgID, userID).First(&m)
+	return m
+}
+
+// orgAdmins counts the active admins left in the organization
+func orgAdmins(orgID uint) int64 {
+	var count int64
+	App.DB.Model(&Membership{}).
+		Where("organization_id = ? AND role = ? AND status = ?", orgID, OrgRoleAdmin, MembershipActive).
+		Count(&count)
+	return count
+}
+
+// canAccessOrg tells if the signed in user is an active member of the organization,
+// or one of its admins when manage is set. Global admins holding
+// orgs.manage pass for every organization.
+func canAccessOrg(r *http.Request, orgID uint, manage bool) bool {
+	if requestHasPermission(r, "orgs.manage") {
+		return true
+	}
+
+	m := findMembership(orgID, currentUserID(r))
+	return m.Status == MembershipActive && (!manage || m.Role == OrgRoleAdmin)
+}
+
+// orgAccess loads the organization from the route and checks the current user
+// may see it, or manage it when manage is set
+func orgAccess(w http.ResponseWriter, r *http.Request, rsp *core.Response, manage bool) (Organization, bool) {
+	var org Organization
+
+	vars := mux.Vars(r)
+	App.DB.First(&org, vars["id"])
+
+	if org.ID == 0 {
+		rsp.Errors.Add("ID", "Organization not found")
+		return org, false
+	}
+
+	if canAccessOrg(r, org.ID, manage) {
+		return org, true
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	rsp.Errors.Add("token", "Permission denied")
+	return org, false
+}
+
+func actionOrgGetAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		orgs   Organizations
+		rsp    = core.Response{Data: &orgs, Req: r}
+		userID = currentUserID(r)
+		db     = App.DB
+	)
+
+	if !requestHasPermission(r, "orgs.manage") {
+		db = db.Where(`id IN (
+			SELECT organization_id FROM memberships
+			WHERE user_id = ? AND status = ? AND deleted_at IS NULL)`,
+			userID, MembershipActive)
+	}
+
+	db.Order("name").Find(&orgs)
+
+	rsp.Data = &orgs
+	rsp.Count = int64(len(orgs))
+
+	w.Write(rsp.Make())
+}
+
+func actionOrgGetOne(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	if org, ok := orgAccess(w, r, &rsp, false); ok {
+		rsp.Data = &org
+	}
+
+	w.Write(rsp.Make())
+}
+
+// actionOrgCreate makes the creator the first admin of the organization
+func actionOrgCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		org Organization
+		rsp = core.Response{Data: &org, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			org.Model = gorm.Model{}
+			userID := currentUserID(r)
+
+			tx := App.DB.Begin()
+			err := tx.Create(&org).Error
+			if err == nil {
+				err = tx.Create(&Membership{
+					OrganizationID: org.ID,
+					UserID:         userID,
+					Role:           OrgRoleAdmin,
+					Status:         MembershipActive,
+				}).Error
+			}
+			if err != nil {
+				tx.Rollback()
+			} else {
+				err = tx.Commit().Error
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("name", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionOrgUpdate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data Organization
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			if org, ok := orgAccess(w, r, &rsp, true); ok {
+				data.Model = gorm.Model{}
+				if err := App.DB.Model(&org).Updates(data).Error; err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("ID", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else {
+					rsp.Data = &org
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionOrgDelete(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	if org, ok := orgAccess(w, r, &rsp, true); ok {
+		tx := App.DB.Begin()
+		tx.Where("organization_id = ?", org.ID).Delete(&Membership{})
+		tx.Delete(&org)
+		if err := tx.Commit().Error; err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp.Errors.Add("ID", "Data saving error")
+			log.Println("Data saving error: " + err.Error())
+		}
+		rsp.Data = &org
+	}
+
+	w.Write(rsp.Make())
+}
+
+// actionOrgUserGetAll is the tenant scoped version of actionGetAll,
+// it takes the same filters and lists the members with their membership
+func actionOrgUserGetAll(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	org, ok := orgAccess(w, r, &rsp, true)
+	if !ok {
+		w.Write(rsp.Make())
+		return
+	}
+
+	db := App.DB.
+		Joins("JOIN memberships ON memberships.user_id = users.id AND memberships.deleted_at IS NULL").
+		Where("memberships.organization_id = ?", org.ID).
+		Preload("Memberships", "organization_id = ?", org.ID)
+
+	findUsers(w, r, db)
+}
+
+// actionOrgMemberInvite adds an existing user as an invited member
+// and mails them the link to accept
+func actionOrgMemberInvite(w http.ResponseWriter, r *http.Request) {
+	var (
+		data MemberInvite
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			org, ok := orgAccess(w, r, &rsp, true)
+			if ok {
+				App.DB.Where("email = ?", data.Email).First(&user)
+			}
+			m := findMembership(org.ID, user.ID)
+
+			if !ok {
+				//orgAccess has set the error
+			} else if user.ID == 0 {
+				rsp.Errors.Add("email", "User not found")
+			} else if m.Status == MembershipActive {
+				rsp.Errors.Add("email", "User is already a member")
+			} else {
+				m.OrganizationID = org.ID
+				m.UserID = user.ID
+				m.Role = data.Role
+				m.Status = MembershipInvited
+				m.InvitedBy = currentUserID(r)
+
+				if err := App.DB.Save(&m).Error; err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("email", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else if token, err := issueVerificationToken(user.ID, PurposeOrgInvite, strconv.Itoa(int(m.ID))); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("email", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else {
+					App.Mail.Send(
+						user.Email,
+						"Invitation to "+org.Name,
+						"You are invited to join "+org.Name+", to accept go to the link "+data.CallBackUrl+"?invitetoken="+token,
+					)
+					if App.IsTest {
+						log.Println("To accept the invitation, go to the link " + data.CallBackUrl + "?invitetoken=" + token)
+					}
+					rsp.Data = &m
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionOrgMemberUpdate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data MemberUpdate
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			org, ok := orgAccess(w, r, &rsp, true)
+			vars := mux.Vars(r)
+			userID, _ := strconv.Atoi(vars["uid"])
+			m := findMembership(org.ID, uint(userID))
+
+			if !ok {
+				//orgAccess has set the error
+			} else if m.ID == 0 {
+				rsp.Errors.Add("uid", "Member not found")
+			} else if m.Role == OrgRoleAdmin && data.Role != OrgRoleAdmin && orgAdmins(org.ID) <= 1 {
+				rsp.Errors.Add("role", "Organization must keep at least one admin")
+			} else if err := App.DB.Model(&m).Update("role", data.Role).Error; err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("role", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				rsp.Data = &m
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionOrgMemberDelete(w http.ResponseWriter, r *http.Request) {
+	rsp := core.Response{Req: r}
+
+	org, ok := orgAccess(w, r, &rsp, true)
+	vars := mux.Vars(r)
+	userID, _ := strconv.Atoi(vars["uid"])
+	m := findMembership(org.ID, uint(userID))
+
+	if !ok {
+		//orgAccess has set the error
+	} else if m.ID == 0 {
+		rsp.Errors.Add("uid", "Member not found")
+	} else if m.Role == OrgRoleAdmin && m.Status == MembershipActive && orgAdmins(org.ID) <= 1 {
+		rsp.Errors.Add("uid", "Organization must keep at least one admin")
+	} else if err := App.DB.Unscoped().Delete(&m).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("uid", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	} else {
+		rsp.Data = &m
+	}
+
+	w.Write(rsp.Make())
+}
+
+// actionInvitationAccept activates the membership, the emailed token
+// proves the invitee owns the address so no sign in is needed
+func actionInvitationAccept(w http.ResponseWriter, r *http.Request) {
+	var (
+		data InvitationAccept
+		m    Membership
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vt, ok := useVerificationToken(data.Token, PurposeOrgInvite)
+			if ok {
+				App.DB.Where("id = ? AND user_id = ?", vt.Payload, vt.UserID).First(&m)
+			}
+
+			if m.ID == 0 {
+				rsp.Errors.Add("token", "Invitation not found")
+			} else if err := App.DB.Model(&m).Update("status", MembershipActive).Error; err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("token", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				rsp.Data = &m
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
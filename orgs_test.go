@@ -0,0 +1,134 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+)
+
+type TestOrganization struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   Organization    `json:"data"`
+}
+
+type TestOrganizations struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   Organizations   `json:"data"`
+}
+
+func readOrganizationBody(r *http.Response) TestOrganization {
+	var o TestOrganization
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &o)
+	defer r.Body.Close()
+	return o
+}
+
+func readOrganizationsBody(r *http.Response) TestOrganizations {
+	var o TestOrganizations
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &o)
+	defer r.Body.Close()
+	return o
+}
+
+//"/api/users/orgs", protectAuth(actionOrgCreate)).Methods("POST")
+func TestOrganizationMembers(t *testing.T) {
+	admin := loginAdmin(t)
+	user := loginTestUser(t)
+
+	resp := doRequest(Murl+"/orgs", "POST", `{"name":"Test Company"}`, admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	org := readOrganizationBody(resp)
+
+	if len(org.Errors) != 0 {
+		t.Fatal(org.Errors)
+	}
+
+	orgID := org.Data.ID
+	members := fmt.Sprintf("%s/orgs/%d/members", Murl, orgID)
+
+	//"/api/users/orgs/{id}/members", protectAuth(actionOrgMemberInvite)).Methods("POST")
+	resp = doRequest(members, "POST", `{"email":"testuser@test.t", "role":"member"}`, user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(members, "POST", `{"email":"testuser@test.t", "role":"member", "callBackUrl":"http://test.ttt"}`, admin.Data.Token)
+
+	org = readOrganizationBody(resp)
+
+	if len(org.Errors) != 0 {
+		t.Fatal(org.Errors)
+	}
+
+	resp = doRequest(Murl+"/orgs", "GET", "", user.Data.Token)
+
+	orgs := readOrganizationsBody(resp)
+
+	if len(orgs.Data) != 0 {
+		t.Fatal("invited user sees the organization before accepting")
+	}
+
+	//"/api/users/orgs/invitations/accept", actionInvitationAccept).Methods("POST")
+	resp = doRequest(Murl+"/orgs/invitations/accept", "POST", `{"token":"testorginvitetoken"}`, "")
+
+	org = readOrganizationBody(resp)
+
+	if len(org.Errors) != 0 {
+		t.Fatal(org.Errors)
+	}
+
+	resp = doRequest(Murl+"/orgs", "GET", "", user.Data.Token)
+
+	orgs = readOrganizationsBody(resp)
+
+	if len(orgs.Data) != 1 {
+		t.Fatal("member does not see the organization")
+	}
+
+	//"/api/users/orgs/{id}/members", protectAuth(actionOrgUserGetAll)).Methods("GET")
+	resp = doRequest(members, "GET", "", user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(members, "GET", "", admin.Data.Token)
+
+	u := readUsersBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(u.Data))
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/orgs/%d", Murl, orgID), "DELETE", "", admin.Data.Token)
+
+	org = readOrganizationBody(resp)
+
+	if len(org.Errors) != 0 {
+		t.Fatal(org.Errors)
+	}
+
+	return
+}
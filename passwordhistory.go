@@ -0,0 +1,179 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+// PasswordHistory keeps the hashes of the last Config.PasswordHistory
+// passwords of a user, so a reset or change can not bring one back
+type PasswordHistory struct {
+	gorm.Model
+	UserID uint   `gorm:"index;not null"`
+	Hash   string `gorm:"not null"`
+}
+
+// PasswordExpired is returned by the sign in actions instead of the user
+// once the password is older than Config.MaxPasswordAge
+type PasswordExpired struct {
+	PasswordExpired bool   `json:"password_expired"`
+	ChangeToken     string `json:"changeToken"`
+}
+
+// ExpiredPasswordChange only sets a new password, the user signs in again
+// afterwards so the second factor is still asked for
+type ExpiredPasswordChange struct {
+	ChangeToken string `json:"changeToken" valid:"required"`
+	Password    string `json:"password" valid:"ascii,required"`
+	RePassword  string `json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
+}
+
+// recordPassword is called after every new password hash is saved,
+// it stamps password_changed_at and trims the history
+func recordPassword(userID uint, hash string) {
+	err := App.DB.Model(&User{}).
+		Where("id = ?", userID).
+		UpdateColumn("password_changed_at", time.Now()).Error
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	if Config.PasswordHistory <= 0 {
+		return
+	}
+
+	if err := App.DB.Create(&PasswordHistory{UserID: userID, Hash: hash}).Error; err != nil {
+		log.Println("Data saving error: " + err.Error())
+		return
+	}
+
+	var keep []uint
+	App.DB.Model(&PasswordHistory{}).
+		Where("user_id = ?", userID).
+		Order("id DESC").
+		Limit(Config.PasswordHistory).
+		Pluck("id", &keep)
+
+	App.DB.Unscoped().
+		Where("user_id = ? AND id NOT IN (?)", userID, keep).
+		Delete(&PasswordHistory{})
+}
+
+// passwordReused checks the password against the current hash
+// and the last Config.PasswordHistory ones
+func passwordReused(user User, password string) bool {
+	if Config.PasswordHistory <= 0 {
+		return false
+	}
+
+	if checkPassword(user, password) {
+		return true
+	}
+
+	var history []PasswordHistory
+	App.DB.Where("user_id = ?", user.ID).
+		Order("id DESC").
+		Limit(Config.PasswordHistory).
+		Find(&history)
+
+	for _, h := range history {
+		if checkPassword(User{Password: h.Hash}, password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func passwordExpired(user User) bool {
+	return Config.MaxPasswordAge > 0 &&
+		user.PasswordChangedAt != nil &&
+		time.Since(*user.PasswordChangedAt) > Config.MaxPasswordAge
+}
+
+// expiredPasswordChange issues the token for changing an expired password,
+// every sign in path hands it out instead of a session
+func expiredPasswordChange(w http.ResponseWriter, rsp *core.Response, user User) PasswordExpired {
+	var expired PasswordExpired
+
+	token, err := issueVerificationToken(user.ID, PurposeExpired, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("password", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+		return expired
+	}
+
+	rsp.Errors.Add("password", "password_expired")
+	expired.PasswordExpired = true
+	expired.ChangeToken = token
+
+	return expired
+}
+
+// migratePasswordChangedAt starts the age of existing passwords on the first
+// Configure, so enabling MaxPasswordAge does not expire everyone at once
+func migratePasswordChangedAt() {
+	err := App.DB.Model(&User{}).
+		Where("password_changed_at IS NULL").
+		UpdateColumn("password_changed_at", time.Now()).Error
+	if err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+}
+
+func actionPasswordExpired(w http.ResponseWriter, r *http.Request) {
+	var (
+		data ExpiredPasswordChange
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			//the token is only consumed once the new password is accepted
+			token := findVerificationToken(data.ChangeToken, PurposeExpired)
+			if token.ID != 0 {
+				App.DB.Preload("Profile").First(&user, token.UserID)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("changeToken", "User with this token is not found")
+			} else if !checkPasswordPolicy(&rsp, data.Password, user) {
+				//checkPasswordPolicy has set the errors
+			} else if passwordReused(user, data.Password) {
+				rsp.Errors.Add("password", "Password was used recently")
+			} else if _, ok := useVerificationToken(data.ChangeToken, PurposeExpired); !ok {
+				rsp.Errors.Add("changeToken", "User with this token is not found")
+			} else if passhash, err := hashPassword(data.Password); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("password", "Password hashing error")
+				log.Println("Password hashing error: " + err.Error())
+			} else {
+				res := App.DB.Model(&user).Updates(map[string]interface{}{
+					"password":    passhash,
+					"salt":        "",
+					"legacy_hash": false,
+				})
+				if res.Error != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("password", "Data saving error")
+					log.Println("Data saving error: " + res.Error.Error())
+				} else {
+					recordPassword(user.ID, passhash)
+					revokeUserTokens(user.ID)
+				}
+			}
+		}
+	}
+
+	data.Password = ""
+	data.RePassword = ""
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
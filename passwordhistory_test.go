@@ -0,0 +1,74 @@
+package users
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/icrowley/fake"
+)
+
+//"/api/users/{id}", actionUpdate).Methods("PATCH")
+func TestPasswordHistory(t *testing.T) {
+	var u UserData
+
+	admin := loginAdmin(t)
+
+	resp := doRequest(Murl, "POST", `{
+		"email":"`+fake.EmailAddress()+`",
+		"password":"good.PASS123",
+		"repassword":"good.PASS123",
+		"role":"user",
+		"status":"active"
+	}`, admin.Data.Token)
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	url := Murl + "/" + fmt.Sprint(u.Data.ID)
+
+	resp = doRequest(url, "PATCH", `{"status":"active", "password":"other.PASS456", "repassword":"other.PASS456"}`, admin.Data.Token)
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	resp = doRequest(url, "PATCH", `{"status":"active", "password":"good.PASS123", "repassword":"good.PASS123"}`, admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("previous password accepted")
+	}
+
+	doRequest(url, "DELETE", "", admin.Data.Token)
+
+	return
+}
+
+//"/api/users/password/expired", actionPasswordExpired).Methods("POST")
+func TestPasswordExpired(t *testing.T) {
+	var u UserData
+
+	resp := doRequest(Murl+"/password/expired", "POST", `{"changeToken":"wrongtoken", "password":"new.PASS789", "repassword":"new.PASS789"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("wrong change token accepted")
+	}
+
+	return
+}
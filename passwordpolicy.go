@@ -0,0 +1,146 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-rest-framework/core"
+)
+
+// PasswordPolicy describes what a new password must look like.
+// Zero values switch a rule off.
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLower  bool
+	RequireUpper  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// MaxRepeated is the longest allowed run of one character, "aaa" is a run of 3
+	MaxRepeated int
+	// ForbidPersonal rejects passwords containing the email or the names of the user
+	ForbidPersonal bool
+}
+
+// PolicyViolation is one broken rule, Rule is a stable code for clients
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// personal parts shorter than this are too common to block
+const minPersonalLength = 3
+
+// Check returns every rule the password breaks,
+// personal holds the email and the names of the user
+func (p PasswordPolicy) Check(password string, personal ...string) []PolicyViolation {
+	var (
+		v                           []PolicyViolation
+		lower, upper, digit, symbol bool
+		run, longest                int
+		prev                        rune
+		length                      = utf8.RuneCountInString(password)
+	)
+
+	for i, c := range []rune(password) {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+
+		if i > 0 && c == prev {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		prev = c
+	}
+
+	if p.MinLength > 0 && length < p.MinLength {
+		v = append(v, PolicyViolation{"min_length", fmt.Sprintf("Password must be at least %d characters long", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		v = append(v, PolicyViolation{"max_length", fmt.Sprintf("Password must be at most %d characters long", p.MaxLength)})
+	}
+	if p.RequireLower && !lower {
+		v = append(v, PolicyViolation{"lower", "Password must contain a lowercase letter"})
+	}
+	if p.RequireUpper && !upper {
+		v = append(v, PolicyViolation{"upper", "Password must contain an uppercase letter"})
+	}
+	if p.RequireDigit && !digit {
+		v = append(v, PolicyViolation{"digit", "Password must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		v = append(v, PolicyViolation{"symbol", "Password must contain a punctuation mark or symbol"})
+	}
+	if p.MaxRepeated > 0 && longest > p.MaxRepeated {
+		v = append(v, PolicyViolation{"repeated", fmt.Sprintf("Password must not repeat a character more than %d times in a row", p.MaxRepeated)})
+	}
+	if p.ForbidPersonal && containsPersonal(password, personal) {
+		v = append(v, PolicyViolation{"personal", "Password must not contain your email or name"})
+	}
+
+	return v
+}
+
+// containsPersonal looks for the email, its local part and the names, ignoring case
+func containsPersonal(password string, personal []string) bool {
+	password = strings.ToLower(password)
+
+	for _, s := range personal {
+		s = strings.ToLower(strings.TrimSpace(s))
+		parts := []string{s}
+		if at := strings.Index(s, "@"); at > 0 {
+			parts = append(parts, s[:at])
+		}
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= minPersonalLength && strings.Contains(password, part) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// personalData lists what ForbidPersonal checks for the user
+func personalData(user User) []string {
+	return []string{
+		user.Email,
+		user.Profile.Firstname,
+		user.Profile.Middlename,
+		user.Profile.Lastname,
+	}
+}
+
+// checkPasswordPolicy adds one error per broken rule of Config.PasswordPolicy
+// and rejects passwords on the blocklist
+func checkPasswordPolicy(rsp *core.Response, password string, user User) bool {
+	violations := Config.PasswordPolicy.Check(password, personalData(user)...)
+
+	if Config.PasswordHasher == "bcrypt" && len(password) > bcryptMaxBytes {
+		violations = append(violations, PolicyViolation{"max_bytes", fmt.Sprintf("Password must be at most %d bytes long", bcryptMaxBytes)})
+	}
+
+	if passwordBlocklist != nil && passwordBlocklist.Contains(password) {
+		violations = append(violations, PolicyViolation{"blocklisted", "Password is too common or has appeared in a data breach"})
+	}
+
+	for _, v := range violations {
+		rsp.Errors.Add("password", v.Rule+": "+v.Message)
+	}
+
+	return len(violations) == 0
+}
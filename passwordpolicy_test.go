@@ -0,0 +1,85 @@
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:      8,
+		MaxLength:      16,
+		RequireLower:   true,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		MaxRepeated:    3,
+		ForbidPersonal: true,
+	}
+
+	tests := []struct {
+		password string
+		rules    []string
+	}{
+		{"good.PASS123", nil},
+		{"aaAA11..", nil},
+		{"aA1.", []string{"min_length"}},
+		{"good.PASS123456789", []string{"max_length"}},
+		{"GOOD.PASS123", []string{"lower"}},
+		{"good.pass123", []string{"upper"}},
+		{"good.PASSabc", []string{"digit"}},
+		{"goodPASS123", []string{"symbol"}},
+		{"goood.PASS123", nil},
+		{"gooood.PASS123", []string{"repeated"}},
+		{"John.Smith1", []string{"personal"}},
+		{"jsmith.X12", []string{"personal"}},
+		{"password", []string{"upper", "digit", "symbol"}},
+	}
+
+	for _, tt := range tests {
+		got := policy.Check(tt.password, "jsmith@example.com", "John", "", "Smith")
+
+		if len(got) != len(tt.rules) {
+			t.Errorf("%q: got %v, want %v", tt.password, got, tt.rules)
+			continue
+		}
+		for i, v := range got {
+			if v.Rule != tt.rules[i] {
+				t.Errorf("%q: got rule %s, want %s", tt.password, v.Rule, tt.rules[i])
+			}
+		}
+	}
+}
+
+func TestPasswordPolicyDisabledRules(t *testing.T) {
+	if v := (PasswordPolicy{}).Check("a", "a@a.a"); len(v) != 0 {
+		t.Fatalf("zero policy rejected a password: %v", v)
+	}
+}
+
+func TestPasswordPolicyBcrypt(t *testing.T) {
+	saved := Config.PasswordHasher
+	defer func() { Config.PasswordHasher = saved }()
+
+	//100 bytes, within the default MaxLength of 128 characters
+	password := "good.PASS1" + strings.Repeat("x1.X", 22) + "ab"
+	if len(password) != 100 {
+		t.Fatalf("test password is %d bytes", len(password))
+	}
+
+	Config.PasswordHasher = "argon2id"
+	if !checkPasswordPolicy(&core.Response{}, password, User{}) {
+		t.Fatal("100 byte password refused with argon2id")
+	}
+
+	Config.PasswordHasher = "bcrypt"
+	if checkPasswordPolicy(&core.Response{}, password, User{}) {
+		t.Fatal("100 byte password accepted with bcrypt")
+	}
+
+	if _, err := (BcryptHasher{Cost: 4}).Hash(password[:bcryptMaxBytes]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -8,5 +8,5 @@ type Profile struct {
 	Middlename string `json:"middlename"`
 	Lastname   string `json:"lastname"`
 	Phone      string `json:"phone"`
-	Avatar     string `json:"avatar" gorm:"type:text"`
+	Avatar     string `json:"avatar" gorm:"size:2048" valid:"avatarurl~avatar: Avatar must be a link, upload images to /users/{id}/avatar"`
 }
@@ -0,0 +1,482 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Permission is a named action such as "users.update"
+type Permission struct {
+	gorm.Model
+	Name        string `json:"name" gorm:"unique;not null"`
+	Description string `json:"description"`
+}
+
+type Permissions []Permission
+
+// Role groups permissions. User.Role holds the primary role,
+// User.Roles holds any additional ones.
+type Role struct {
+	gorm.Model
+	Name        string      `json:"name" gorm:"unique;not null"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions" gorm:"many2many:role_permissions"`
+}
+
+type Roles []Role
+
+type RoleData struct {
+	Name        string   `json:"name" valid:"required,matches(^[a-z][a-z0-9_-]*$),uniquerole~name: Role not unique"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleUpdate struct {
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type UserRoles struct {
+	Roles []string `json:"roles"`
+}
+
+// builtin roles can not be deleted
+var builtinRoles = []string{"candidate", "user", "admin"}
+
+// BuiltinPermissions are created on Configure and granted to the admin role
+var BuiltinPermissions = map[string]string{
+	"users.read":        "List and view users",
+	"users.create":      "Create users",
+	"users.update":      "Update users and their roles",
+	"users.delete":      "Delete users",
+	"users.sessions":    "View and terminate sessions of users",
+	"users.2fa":         "Reset two-factor authentication of users",
+	"users.passwords":   "View password storage statistics",
+	"roles.read":        "List roles and permissions",
+	"roles.manage":      "Create, update and delete roles and permissions",
+	"orgs.manage":       "Manage every organization and its members",
+	"users.impersonate": "Sign in as other users",
+	"users.audit":       "View the audit log",
+	"users.keywords":    "Create, update and delete user keywords",
+}
+
+func init() {
+	govalidator.TagMap["rolename"] = govalidator.Validator(func(str string) bool {
+		return roleExists(str)
+	})
+	govalidator.TagMap["uniquerole"] = govalidator.Validator(func(str string) bool {
+		return !roleExists(str)
+	})
+}
+
+func roleExists(name string) bool {
+	var role Role
+	App.DB.Where("name = ?", name).First(&role)
+	return role.ID != 0
+}
+
+func isBuiltinRole(name string) bool {
+	for _, v := range builtinRoles {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// seedRoles makes sure the builtin roles and permissions exist
+// and that admin holds every builtin permission
+func seedRoles() {
+	var (
+		admin       Role
+		permissions Permissions
+	)
+
+	for name, description := range BuiltinPermissions {
+		var p Permission
+		App.DB.Where(Permission{Name: name}).Attrs(Permission{Description: description}).FirstOrCreate(&p)
+		permissions = append(permissions, p)
+	}
+
+	for _, name := range builtinRoles {
+		var role Role
+		App.DB.Where(Role{Name: name}).FirstOrCreate(&role)
+		if name == "admin" {
+			admin = role
+		}
+	}
+
+	if err := App.DB.Model(&admin).Association("Permissions").Append(permissions).Error; err != nil {
+		log.Println("Data saving error: " + err.Error())
+	}
+}
+
+// roleCache keeps the role names protectAuth checks on every request,
+// roles created on other nodes are let in after roleCacheTTL at most
+var roleCache struct {
+	sync.Mutex
+	names  []string
+	loaded time.Time
+}
+
+const roleCacheTTL = time.Minute
+
+func roleNames() []string {
+	roleCache.Lock()
+	defer roleCache.Unlock()
+
+	if roleCache.names == nil || time.Since(roleCache.loaded) > roleCacheTTL {
+		var names []string
+		App.DB.Model(&Role{}).Pluck("name", &names)
+		roleCache.names = names
+		roleCache.loaded = time.Now()
+	}
+
+	return roleCache.names
+}
+
+func forgetRoleNames() {
+	roleCache.Lock()
+	roleCache.names = nil
+	roleCache.Unlock()
+}
+
+func findPermissions(names []string) (Permissions, bool) {
+	var permissions Permissions
+	if len(names) == 0 {
+		return permissions, true
+	}
+	App.DB.Where("name IN (?)", names).Find(&permissions)
+	return permissions, len(permissions) == len(names)
+}
+
+// hasPermission checks the primary and the additional roles of the user
+func hasPermission(userID uint, permission string) bool {
+	return hasAnyPermission(userID, []string{permission})
+}
+
+// hasAnyPermission tells if the user holds at least one of the permissions
+func hasAnyPermission(userID uint, permissions []string) bool {
+	var count int64
+
+	App.DB.Table("permissions").
+		Joins("JOIN role_permissions ON role_permissions.permission_id = permissions.id").
+		Joins("JOIN roles ON roles.id = role_permissions.role_id AND roles.deleted_at IS NULL").
+		Where("permissions.name IN (?) AND permissions.deleted_at IS NULL", permissions).
+		Where(`roles.name = (SELECT role FROM users WHERE id = ?)
+			OR roles.id IN (SELECT role_id FROM user_roles WHERE user_id = ?)`, userID, userID).
+		Count(&count)
+
+	return count != 0
+}
+
+// requestHasPermission is hasPermission for the signed in user,
+// narrowed to the scopes of the API key the request came with
+func requestHasPermission(r *http.Request, permission string) bool {
+	key, byKey := currentAPIKey(r)
+	return hasPermission(currentUserID(r), permission) && (!byKey || key.hasScope(permission))
+}
+
+// canAssignRoles tells if the signed in user may change the roles of users,
+// users.update alone would let them grant themselves any permission
+func canAssignRoles(r *http.Request) bool {
+	return requestHasPermission(r, "roles.manage")
+}
+
+// protectSignedIn lets in any signed in user or API key whatever role they hold
+func protectSignedIn(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		protect(next, roleNames())(w, r)
+	}
+}
+
+// protectAuth lets in any signed in user whatever role they hold.
+// API keys are refused, they only open routes guarded by ProtectPermission.
+func protectAuth(next http.HandlerFunc) http.HandlerFunc {
+	return protectSignedIn(func(w http.ResponseWriter, r *http.Request) {
+		if _, byKey := currentAPIKey(r); byKey {
+			rsp := core.Response{Req: r}
+			w.WriteHeader(http.StatusForbidden)
+			rsp.Errors.Add("token", "Permission denied: API keys can only use routes within their scopes")
+			w.Write(rsp.Make())
+			return
+		}
+		next(w, r)
+	})
+}
+
+// ProtectPermission lets in signed in users holding the permission
+// through any of their roles, API keys also need it among their scopes
+func ProtectPermission(next http.HandlerFunc, permission string) http.HandlerFunc {
+	return protectSignedIn(func(w http.ResponseWriter, r *http.Request) {
+		if !requestHasPermission(r, permission) {
+			rsp := core.Response{Req: r}
+			w.WriteHeader(http.StatusForbidden)
+			rsp.Errors.Add("token", "Permission denied: "+permission)
+			w.Write(rsp.Make())
+			return
+		}
+		next(w, r)
+	})
+}
+
+func actionRoleGetAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		roles Roles
+		rsp   = core.Response{Data: &roles, Req: r}
+	)
+
+	App.DB.Preload("Permissions").Order("name").Find(&roles)
+
+	rsp.Data = &roles
+	rsp.Count = int64(len(roles))
+
+	w.Write(rsp.Make())
+}
+
+func actionRoleGetOne(w http.ResponseWriter, r *http.Request) {
+	var (
+		role Role
+		rsp  = core.Response{Data: &role, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.Preload("Permissions").First(&role, vars["id"])
+
+	if role.ID == 0 {
+		rsp.Errors.Add("ID", "Role not found")
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionRoleCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data RoleData
+		role Role
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			permissions, ok := findPermissions(data.Permissions)
+			if !ok {
+				rsp.Errors.Add("permissions", "Permission not found")
+			} else {
+				role.Name = data.Name
+				role.Description = data.Description
+				role.Permissions = permissions
+				if res := App.DB.Create(&role); res.Error != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("name", "Data saving error")
+					log.Println("Data saving error: " + res.Error.Error())
+				} else {
+					forgetRoleNames()
+					rsp.Data = &role
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionRoleUpdate(w http.ResponseWriter, r *http.Request) {
+	var (
+		data RoleUpdate
+		role Role
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vars := mux.Vars(r)
+			App.DB.First(&role, vars["id"])
+			permissions, ok := findPermissions(data.Permissions)
+
+			if role.ID == 0 {
+				rsp.Errors.Add("ID", "Role not found")
+			} else if !ok {
+				rsp.Errors.Add("permissions", "Permission not found")
+			} else {
+				tx := App.DB.Begin()
+				err := tx.Model(&role).Update("description", data.Description).Error
+				if err == nil && data.Permissions != nil {
+					err = tx.Model(&role).Association("Permissions").Replace(permissions).Error
+				}
+				if err != nil {
+					tx.Rollback()
+				} else {
+					err = tx.Commit().Error
+				}
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("ID", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else {
+					App.DB.Preload("Permissions").First(&role, role.ID)
+					rsp.Data = &role
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionRoleDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		role  Role
+		count int64
+		rsp   = core.Response{Data: &role, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&role, vars["id"])
+	App.DB.Model(&User{}).Where("role = ?", role.Name).Count(&count)
+
+	if role.ID == 0 {
+		rsp.Errors.Add("ID", "Role not found")
+	} else if isBuiltinRole(role.Name) {
+		rsp.Errors.Add("ID", "Builtin roles can not be deleted")
+	} else if count != 0 {
+		rsp.Errors.Add("ID", "Role is the primary role of some users")
+	} else {
+		tx := App.DB.Begin()
+		err := tx.Model(&role).Association("Permissions").Clear().Error
+		if err == nil {
+			err = tx.Exec("DELETE FROM user_roles WHERE role_id = ?", role.ID).Error
+		}
+		if err == nil {
+			err = tx.Unscoped().Delete(&role).Error
+		}
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit().Error
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp.Errors.Add("ID", "Data saving error")
+			log.Println("Data saving error: " + err.Error())
+		} else {
+			forgetRoleNames()
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionPermissionGetAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		permissions Permissions
+		rsp         = core.Response{Data: &permissions, Req: r}
+	)
+
+	App.DB.Order("name").Find(&permissions)
+
+	rsp.Data = &permissions
+	rsp.Count = int64(len(permissions))
+
+	w.Write(rsp.Make())
+}
+
+func actionPermissionCreate(w http.ResponseWriter, r *http.Request) {
+	var (
+		model Permission
+		rsp   = core.Response{Data: &model, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			var exists Permission
+			App.DB.Where("name = ?", model.Name).First(&exists)
+			if model.Name == "" {
+				rsp.Errors.Add("name", "Name is required")
+			} else if exists.ID != 0 {
+				rsp.Errors.Add("name", "Permission not unique")
+			} else {
+				model.Model = gorm.Model{}
+				App.DB.Create(&model)
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionPermissionDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		model Permission
+		rsp   = core.Response{Data: &model, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&model, vars["id"])
+
+	if model.ID == 0 {
+		rsp.Errors.Add("ID", "Permission not found")
+	} else if _, ok := BuiltinPermissions[model.Name]; ok {
+		rsp.Errors.Add("ID", "Builtin permissions can not be deleted")
+	} else {
+		tx := App.DB.Begin()
+		err := tx.Exec("DELETE FROM role_permissions WHERE permission_id = ?", model.ID).Error
+		if err == nil {
+			err = tx.Unscoped().Delete(&model).Error
+		}
+		if err != nil {
+			tx.Rollback()
+		} else {
+			err = tx.Commit().Error
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp.Errors.Add("ID", "Data saving error")
+			log.Println("Data saving error: " + err.Error())
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionUserRoles(w http.ResponseWriter, r *http.Request) {
+	var (
+		data  UserRoles
+		user  User
+		roles Roles
+		rsp   = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			vars := mux.Vars(r)
+			App.DB.First(&user, vars["id"])
+			if len(data.Roles) != 0 {
+				App.DB.Where("name IN (?)", data.Roles).Find(&roles)
+			}
+
+			if user.ID == 0 {
+				rsp.Errors.Add("ID", "User not found")
+			} else if len(roles) != len(data.Roles) {
+				rsp.Errors.Add("roles", "Role not found")
+			} else if err := App.DB.Model(&user).Association("Roles").Replace(roles).Error; err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("roles", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.DB.Preload("Profile").Preload("Roles").First(&user, user.ID)
+				user.Password = ""
+				rsp.Data = &user
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,121 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+)
+
+type TestRole struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   Role            `json:"data"`
+}
+
+func readRoleBody(r *http.Response) TestRole {
+	var role TestRole
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &role)
+	defer r.Body.Close()
+	return role
+}
+
+//"/api/users/roles", ProtectPermission(actionRoleCreate, "roles.manage")).Methods("POST")
+func TestRoles(t *testing.T) {
+	var u UserData
+
+	admin := loginAdmin(t)
+	user := loginTestUser(t)
+
+	resp := doRequest(Murl, "GET", "", user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/roles", "POST", `{"name":"admin"}`, admin.Data.Token)
+
+	role := readRoleBody(resp)
+
+	if len(role.Errors) == 0 {
+		t.Fatal("role unique validation dont work")
+	}
+
+	resp = doRequest(Murl+"/roles", "POST", `{"name":"support", "permissions":["users.read", "users.update"]}`, admin.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	role = readRoleBody(resp)
+
+	if len(role.Errors) != 0 {
+		t.Fatal(role.Errors)
+	}
+
+	//"/api/users/{id}/roles", ProtectPermission(actionUserRoles, "roles.manage")).Methods("PUT")
+	url := fmt.Sprintf("%s/%d/roles", Murl, user.Data.ID)
+	resp = doRequest(url, "PUT", `{"roles":["support"]}`, admin.Data.Token)
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data.Roles) != 1 {
+		t.Fatal("role not assigned")
+	}
+
+	resp = doRequest(Murl, "GET", "", user.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/%d", Murl, user.Data.ID), "DELETE", "", user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	//users.update does not let the user grant roles
+	resp = doRequest(url, "PUT", `{"roles":["admin"]}`, user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(fmt.Sprintf("%s/%d", Murl, user.Data.ID), "PATCH", `{"role":"admin", "status":"active"}`, user.Data.Token)
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Forbidden expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(url, "PUT", `{"roles":[]}`, admin.Data.Token)
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	//"/api/users/roles/{id}", ProtectPermission(actionRoleDelete, "roles.manage")).Methods("DELETE")
+	resp = doRequest(fmt.Sprintf("%s/roles/%d", Murl, role.Data.ID), "DELETE", "", admin.Data.Token)
+
+	role = readRoleBody(resp)
+
+	if len(role.Errors) != 0 {
+		t.Fatal(role.Errors)
+	}
+
+	return
+}
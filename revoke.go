@@ -0,0 +1,182 @@
+package users
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+// RevokedToken is a denylist entry for an access JWT, keyed on its jti claim.
+type RevokedToken struct {
+	gorm.Model
+	JTI       string    `gorm:"unique;not null"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// tokenID returns the jti of a valid access JWT, "" for anything else
+func tokenID(token string) string {
+	if token == "" {
+		return ""
+	}
+	claims, ok := parseAccessToken(token)
+	if !ok {
+		return ""
+	}
+	return claims.Id
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+func revokeAccessToken(jti string, userID uint, expires time.Time) {
+	var revoked RevokedToken
+
+	if jti == "" || expires.Before(time.Now()) {
+		return
+	}
+
+	res := App.DB.Where(RevokedToken{JTI: jti}).
+		Attrs(RevokedToken{UserID: userID, ExpiresAt: expires}).
+		FirstOrCreate(&revoked)
+	if res.Error != nil {
+		log.Println("Data saving error: " + res.Error.Error())
+	}
+}
+
+// revokeUserTokens signs the user out of every device
+func revokeUserTokens(userID uint) {
+	revokeOtherTokens(userID, "")
+}
+
+// revokeOtherTokens signs the user out of every device but the one
+// holding the given token family
+func revokeOtherTokens(userID uint, keepFamily string) {
+	var families []string
+
+	App.DB.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL AND family <> ?", userID, keepFamily).
+		Pluck("DISTINCT family", &families)
+
+	for _, family := range families {
+		revokeTokenFamily(family)
+	}
+}
+
+func isRevoked(jti string) bool {
+	var count int64
+
+	App.DB.Model(&RevokedToken{}).Where("jti = ? AND expires_at > ?", jti, time.Now()).Count(&count)
+
+	return count != 0
+}
+
+// protect wraps App.Protect and additionally rejects revoked tokens,
+// API keys are checked by protectAPIKey instead
+func protect(next http.HandlerFunc, roles []string) http.HandlerFunc {
+	byKey := protectAPIKey(next, roles)
+	byJWT := App.Protect(func(w http.ResponseWriter, r *http.Request) {
+		jti := tokenID(bearerToken(r))
+		if jti == "" {
+			//signed by App.GenToken or with another key
+			rsp := core.Response{Req: r}
+			w.WriteHeader(http.StatusUnauthorized)
+			rsp.Errors.Add("token", "Token is not valid")
+			w.Write(rsp.Make())
+			return
+		}
+		if isRevoked(jti) {
+			rsp := core.Response{Req: r}
+			w.WriteHeader(http.StatusUnauthorized)
+			rsp.Errors.Add("token", "Token has been revoked")
+			w.Write(rsp.Make())
+			return
+		}
+		r = withSession(r, jti)
+		if session, ok := currentSession(r); ok && session.ActorID != 0 {
+			if !checkImpersonation(w, r, session) {
+				return
+			}
+		}
+		next(w, r)
+	}, roles)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isAPIKey(bearerToken(r)) {
+			byKey(w, r)
+			return
+		}
+		byJWT(w, r)
+	}
+}
+
+func cleanupTokens() {
+	revokeExpiredImpersonations()
+
+	now := time.Now()
+	App.DB.Unscoped().Where("expires_at < ?", now).Delete(&RevokedToken{})
+	App.DB.Unscoped().Where("expires_at < ?", now).Delete(&RefreshToken{})
+	App.DB.Where("expires_at < ?", now).Delete(&Session{})
+	App.DB.Unscoped().Where("expires_at < ?", now).Delete(&MFAChallenge{})
+	App.DB.Unscoped().Where("expires_at < ?", now).Delete(&VerificationToken{})
+	loginLocks.Purge(now.Add(-Config.LoginAttemptWindow))
+}
+
+func startTokenCleanup() {
+	//time.NewTicker panics on a non-positive interval
+	if Config.CleanupInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(Config.CleanupInterval)
+	go func() {
+		for range ticker.C {
+			cleanupTokens()
+		}
+	}()
+}
+
+func actionLogout(w http.ResponseWriter, r *http.Request) {
+	var (
+		refresh RefreshToken
+		rsp     = core.Response{Req: r}
+		jti     = tokenID(bearerToken(r))
+	)
+
+	App.DB.Where("access_hash = ?", jti).First(&refresh)
+
+	if refresh.ID != 0 {
+		revokeTokenFamily(refresh.Family)
+	} else {
+		revokeAccessToken(jti, 0, time.Now().Add(Config.AccessTokenTTL))
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionLogoutAll(w http.ResponseWriter, r *http.Request) {
+	var (
+		refresh RefreshToken
+		rsp     = core.Response{Req: r}
+		jti     = tokenID(bearerToken(r))
+	)
+
+	App.DB.Where("access_hash = ?", jti).First(&refresh)
+
+	if refresh.ID == 0 {
+		rsp.Errors.Add("token", "Session not found")
+	} else {
+		revokeUserTokens(refresh.UserID)
+	}
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,295 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Session is one signed in device. It lives as long as its refresh token family.
+// ActorID is set when an admin impersonates the user.
+type Session struct {
+	gorm.Model
+	UserID     uint      `json:"userID" gorm:"index"`
+	ActorID    uint      `json:"actorID"`
+	Family     string    `json:"-" gorm:"unique;not null"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	LastSeenAt time.Time `json:"lastSeenAt"`
+	ExpiresAt  time.Time `json:"expiresAt" gorm:"index"`
+	Current    bool      `json:"current" gorm:"-"`
+}
+
+type Sessions []Session
+
+type contextKey string
+
+const sessionKey contextKey = "users.session"
+
+// trustedProxies is Config.TrustedProxies parsed by Configure
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies accepts CIDRs and single addresses
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", p)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", p)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the peer address, the forwarding headers are only
+// believed when the peer is one of Config.TrustedProxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+
+	//the client can prepend anything, so walk back from the last
+	//proxy to the first address not added by a trusted one
+	if ips := r.Header.Get("X-Forwarded-For"); ips != "" {
+		hops := strings.Split(ips, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(hops[i])
+			if net.ParseIP(ip) == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+	}
+
+	return host
+}
+
+func startSession(r *http.Request, userID uint, family string, expires time.Time) error {
+	agent := r.UserAgent()
+	if len(agent) > 255 {
+		agent = agent[:255]
+	}
+
+	return App.DB.Create(&Session{
+		UserID:     userID,
+		Family:     family,
+		UserAgent:  agent,
+		IP:         clientIP(r),
+		LastSeenAt: time.Now(),
+		ExpiresAt:  expires,
+	}).Error
+}
+
+func extendSession(family string, expires time.Time) error {
+	return App.DB.Model(&Session{}).Where("family = ?", family).Updates(map[string]interface{}{
+		"last_seen_at": time.Now(),
+		"expires_at":   expires,
+	}).Error
+}
+
+func endSession(family string) {
+	App.DB.Where("family = ?", family).Delete(&Session{})
+}
+
+// withSession attaches the session behind the access token to the request
+// and keeps its last seen time fresh
+func withSession(r *http.Request, jti string) *http.Request {
+	var (
+		refresh RefreshToken
+		session Session
+	)
+
+	if jti == "" {
+		return r
+	}
+
+	App.DB.Where("access_hash = ?", jti).First(&refresh)
+	if refresh.ID == 0 {
+		return r
+	}
+
+	App.DB.Where("family = ?", refresh.Family).First(&session)
+	if session.ID == 0 {
+		return r
+	}
+
+	if time.Since(session.LastSeenAt) > time.Minute {
+		session.LastSeenAt = time.Now()
+		App.DB.Model(&session).UpdateColumn("last_seen_at", session.LastSeenAt)
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), sessionKey, session))
+}
+
+func currentSession(r *http.Request) (Session, bool) {
+	session, ok := r.Context().Value(sessionKey).(Session)
+	return session, ok
+}
+
+func findSessions(userID uint, current string) Sessions {
+	var sessions Sessions
+
+	App.DB.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions)
+
+	for k := range sessions {
+		sessions[k].Current = sessions[k].Family == current
+	}
+
+	return sessions
+}
+
+func actionMySessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		sessions Sessions
+		rsp      = core.Response{Data: &sessions, Req: r}
+	)
+
+	current, ok := currentSession(r)
+	if !ok {
+		rsp.Errors.Add("token", "Session not found")
+	} else {
+		sessions = findSessions(current.UserID, current.Family)
+		rsp.Count = int64(len(sessions))
+	}
+
+	rsp.Data = &sessions
+
+	w.Write(rsp.Make())
+}
+
+func actionMySessionDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		session Session
+		rsp     = core.Response{Data: &session, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	current, ok := currentSession(r)
+
+	if !ok {
+		rsp.Errors.Add("token", "Session not found")
+	} else {
+		App.DB.Where("user_id = ?", current.UserID).First(&session, vars["sid"])
+		if session.ID == 0 {
+			rsp.Errors.Add("ID", "Session not found")
+		} else {
+			revokeTokenFamily(session.Family)
+		}
+	}
+
+	rsp.Data = &session
+
+	w.Write(rsp.Make())
+}
+
+func actionUserSessions(w http.ResponseWriter, r *http.Request) {
+	var (
+		user     User
+		sessions Sessions
+		rsp      = core.Response{Data: &sessions, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&user, vars["id"])
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else {
+		current, _ := currentSession(r)
+		sessions = findSessions(user.ID, current.Family)
+		rsp.Count = int64(len(sessions))
+	}
+
+	rsp.Data = &sessions
+
+	w.Write(rsp.Make())
+}
+
+func actionUserSessionDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		session Session
+		rsp     = core.Response{Data: &session, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.Where("user_id = ?", vars["id"]).First(&session, vars["sid"])
+
+	if session.ID == 0 {
+		rsp.Errors.Add("ID", "Session not found")
+	} else {
+		revokeTokenFamily(session.Family)
+	}
+
+	rsp.Data = &session
+
+	w.Write(rsp.Make())
+}
+
+func actionUserSessionsDelete(w http.ResponseWriter, r *http.Request) {
+	var (
+		user User
+		rsp  = core.Response{Data: &user, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&user, vars["id"])
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else {
+		revokeUserTokens(user.ID)
+	}
+
+	user.Password = ""
+	rsp.Data = &user
+
+	w.Write(rsp.Make())
+}
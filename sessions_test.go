@@ -0,0 +1,129 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+)
+
+type TestSessions struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   Sessions        `json:"data"`
+}
+
+func readSessionsBody(r *http.Response) TestSessions {
+	var s TestSessions
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	json.Unmarshal([]byte(body), &s)
+	defer r.Body.Close()
+	return s
+}
+
+//"/api/users/me/sessions", protectAuth(actionMySessions)).Methods("GET")
+func TestMySessions(t *testing.T) {
+	var other Session
+
+	first := loginAdmin(t)
+	second := loginAdmin(t)
+
+	resp := doRequest(Murl+"/me/sessions", "GET", "", second.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	s := readSessionsBody(resp)
+
+	if len(s.Errors) != 0 {
+		t.Fatal(s.Errors)
+	}
+
+	if len(s.Data) < 2 {
+		t.Fatalf("Expected at least 2 sessions, giwen - : %d", len(s.Data))
+	}
+
+	//the newest of the other sessions belongs to the first login
+	for _, v := range s.Data {
+		if !v.Current && v.ID > other.ID {
+			other = v
+		}
+	}
+
+	if other.ID == 0 {
+		t.Fatal("current session not marked")
+	}
+
+	//terminate the first session from the second one
+	resp = doRequest(fmt.Sprintf("%s/me/sessions/%d", Murl, other.ID), "DELETE", "", second.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl, "GET", "", first.Data.Token)
+
+	if resp.StatusCode == 200 {
+		t.Fatal("token of terminated session still accepted")
+	}
+
+	resp = doRequest(Murl, "GET", "", second.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Fatal("current session terminated")
+	}
+
+	return
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := trustedProxies
+	trustedProxies = proxies
+	defer func() { trustedProxies = saved }()
+
+	tests := []struct {
+		remote string
+		real   string
+		fwd    string
+		want   string
+	}{
+		{"203.0.113.5:1234", "1.1.1.1", "2.2.2.2", "203.0.113.5"},
+		{"10.1.2.3:1234", "1.1.1.1", "", "1.1.1.1"},
+		{"10.1.2.3:1234", "", "2.2.2.2, 198.51.100.7", "198.51.100.7"},
+		{"192.168.1.1:1234", "", "198.51.100.7, 10.0.0.9", "198.51.100.7"},
+		{"10.1.2.3:1234", "", "10.0.0.8, 10.0.0.9", "10.0.0.8"},
+		{"10.1.2.3:1234", "", "spoofed", "10.1.2.3"},
+		{"192.168.1.2:1234", "1.1.1.1", "", "192.168.1.2"},
+	}
+
+	for _, tt := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.real != "" {
+			r.Header.Set("X-Real-IP", tt.real)
+		}
+		if tt.fwd != "" {
+			r.Header.Set("X-Forwarded-For", tt.fwd)
+		}
+
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s %q %q: expected %s, got %s", tt.remote, tt.real, tt.fwd, tt.want, got)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy"}); err == nil {
+		t.Errorf("Error expected for an invalid proxy")
+	}
+}
@@ -0,0 +1,63 @@
+package users
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle is an in-memory sliding window rate limiter
+type Throttle struct {
+	Limit  int
+	Window time.Duration
+
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+func NewThrottle(limit int, window time.Duration) *Throttle {
+	return &Throttle{
+		Limit:  limit,
+		Window: window,
+		hits:   map[string][]time.Time{},
+	}
+}
+
+// Allow registers a hit for the key and reports whether it is within the limit
+func (t *Throttle) Allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	hits := t.recent(key, now)
+
+	if len(hits) >= t.Limit {
+		t.hits[key] = hits
+		return false
+	}
+
+	t.hits[key] = append(hits, now)
+
+	if len(t.hits) > 10000 {
+		t.purge(now)
+	}
+
+	return true
+}
+
+func (t *Throttle) recent(key string, now time.Time) []time.Time {
+	hits := t.hits[key]
+	for len(hits) > 0 && now.Sub(hits[0]) >= t.Window {
+		hits = hits[1:]
+	}
+	return hits
+}
+
+func (t *Throttle) purge(now time.Time) {
+	for key := range t.hits {
+		if hits := t.recent(key, now); len(hits) == 0 {
+			delete(t.hits, key)
+		} else {
+			t.hits[key] = hits
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package users
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := NewThrottle(2, 50*time.Millisecond)
+
+	if !th.Allow("a") || !th.Allow("a") {
+		t.Fatal("hits within the limit rejected")
+	}
+
+	if th.Allow("a") {
+		t.Fatal("hit over the limit allowed")
+	}
+
+	if !th.Allow("b") {
+		t.Fatal("keys are not independent")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if !th.Allow("a") {
+		t.Fatal("hit after the window rejected")
+	}
+}
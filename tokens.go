@@ -0,0 +1,229 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+// RefreshToken is an opaque long-lived token stored only as a hash.
+// Tokens issued by rotating one another share the same Family,
+// AccessHash is the jti of the access JWT issued together with the token.
+type RefreshToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"index"`
+	Family     string `gorm:"index"`
+	TokenHash  string `gorm:"unique;not null"`
+	AccessHash string `gorm:"index"`
+	ExpiresAt  time.Time
+	RotatedAt  *time.Time
+	RevokedAt  *time.Time
+}
+
+// AccessClaims are the claims App.GenToken signs plus a jti unique to every token.
+// Act is set on impersonation tokens and names the admin acting as the user.
+type AccessClaims struct {
+	ID     string `json:"id"`
+	Email  string `json:"email"`
+	Role   string `json:"role"`
+	Status string `json:"status"`
+	Act    *Actor `json:"act,omitempty"`
+	jwt.StandardClaims
+}
+
+// Actor is the RFC 8693 act claim
+type Actor struct {
+	Sub string `json:"sub"`
+}
+
+type TokenRefresh struct {
+	RefreshToken string `json:"refreshToken" valid:"required"`
+}
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// signAccessToken issues an access JWT for the user valid for ttl,
+// a non-zero actorID adds the act claim. It is signed with Config.JWTSecret
+// instead of calling App.GenToken, which can not add claims.
+func signAccessToken(user *User, ttl time.Duration, actorID uint) (string, AccessClaims, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", AccessClaims{}, err
+	}
+
+	now := time.Now()
+	claims := AccessClaims{
+		ID:     fmt.Sprintf("%d", user.ID),
+		Email:  user.Email,
+		Role:   user.Role,
+		Status: user.Status,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	if actorID != 0 {
+		claims.Act = &Actor{Sub: fmt.Sprintf("%d", actorID)}
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(Config.JWTSecret)
+	return token, claims, err
+}
+
+// parseAccessToken checks the signature and the expiry of an access JWT
+func parseAccessToken(token string) (AccessClaims, bool) {
+	var claims AccessClaims
+
+	parsed, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if t.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return Config.JWTSecret, nil
+	})
+	if err != nil || !parsed.Valid || claims.Id == "" {
+		return AccessClaims{}, false
+	}
+
+	return claims, true
+}
+
+// genTokens issues an access JWT and a refresh token for the user.
+// An empty family starts a new token family and a new session.
+func genTokens(r *http.Request, user *User, family string) error {
+	newFamily := family == ""
+
+	token, claims, err := signAccessToken(user, Config.AccessTokenTTL, 0)
+	if err != nil {
+		return err
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	if newFamily {
+		family, err = randomToken(16)
+		if err != nil {
+			return err
+		}
+	}
+
+	expires := time.Now().Add(Config.RefreshTokenTTL)
+
+	res := App.DB.Create(&RefreshToken{
+		UserID:     user.ID,
+		Family:     family,
+		TokenHash:  App.ToSum256(refresh),
+		AccessHash: claims.Id,
+		ExpiresAt:  expires,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if newFamily {
+		err = startSession(r, user.ID, family, expires)
+	} else {
+		err = extendSession(family, expires)
+	}
+	if err != nil {
+		return err
+	}
+
+	user.Token = token
+	user.RefreshToken = refresh
+
+	return nil
+}
+
+// revokeTokenFamily revokes every refresh token of the family
+// and denylists the access tokens issued with them
+func revokeTokenFamily(family string) {
+	var tokens []RefreshToken
+
+	App.DB.Where("family = ?", family).Find(&tokens)
+
+	for _, t := range tokens {
+		revokeAccessToken(t.AccessHash, t.UserID, t.CreatedAt.Add(Config.AccessTokenTTL))
+	}
+
+	res := App.DB.Model(&RefreshToken{}).
+		Where("family = ? AND revoked_at IS NULL", family).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		log.Println("Data saving error: " + res.Error.Error())
+	}
+
+	endSession(family)
+}
+
+func actionTokenRefresh(w http.ResponseWriter, r *http.Request) {
+	var (
+		data    TokenRefresh
+		user    User
+		refresh RefreshToken
+		expired PasswordExpired
+		rsp     = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			App.DB.Where("token_hash = ?", App.ToSum256(data.RefreshToken)).First(&refresh)
+			if refresh.ID == 0 || refresh.RevokedAt != nil || refresh.ExpiresAt.Before(time.Now()) {
+				rsp.Errors.Add("refreshToken", "Refresh token is not valid")
+			} else if refresh.RotatedAt != nil {
+				revokeTokenFamily(refresh.Family)
+				rsp.Errors.Add("refreshToken", "Refresh token has already been used, please log in again")
+			} else {
+				res := App.DB.Model(&RefreshToken{}).
+					Where("id = ? AND rotated_at IS NULL", refresh.ID).
+					Update("rotated_at", time.Now())
+				App.DB.Preload("Profile").First(&user, refresh.UserID)
+
+				if res.Error != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("refreshToken", "Data saving error")
+					log.Println("Data saving error: " + res.Error.Error())
+				} else if res.RowsAffected == 0 {
+					revokeTokenFamily(refresh.Family)
+					rsp.Errors.Add("refreshToken", "Refresh token has already been used, please log in again")
+				} else if user.ID == 0 || user.Status == "blocked" {
+					revokeTokenFamily(refresh.Family)
+					rsp.Errors.Add("refreshToken", "User not found or blocked")
+				} else if passwordExpired(user) {
+					//the rotated token is spent, the user signs in again after the change
+					expired = expiredPasswordChange(w, &rsp, user)
+				} else if err := genTokens(r, &user, refresh.Family); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("refreshToken", "Error generating tokens: "+err.Error())
+				} else {
+					w.Header().Set("Authorization", "Bearer "+user.Token)
+					rsp.Data = &user
+				}
+			}
+		}
+	}
+
+	user.Password = ""
+
+	if expired.PasswordExpired {
+		rsp.Data = &expired
+	}
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,171 @@
+package users
+
+import "testing"
+
+func loginAdmin(t *testing.T) UserData {
+	var u UserData
+
+	resp := doRequest(Murl+"/login", "POST", `{"email":"admin@admin.a", "password":"adminpass"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	return u
+}
+
+//"/api/users/token/refresh", actionTokenRefresh).Methods("POST")
+func TestTokenRefresh(t *testing.T) {
+	var u, reused, rotated UserData
+	url := Murl + "/token/refresh"
+
+	login := loginAdmin(t)
+
+	if login.Data.RefreshToken == "" {
+		t.Fatal("no refresh token on login")
+	}
+
+	resp := doRequest(url, "POST", `{"refreshToken":"wrongtoken"}`, "")
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("wrong refresh token accepted")
+	}
+
+	resp = doRequest(url, "POST", `{"refreshToken":"`+login.Data.RefreshToken+`"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	rotated.Read(resp)
+
+	if len(rotated.Errors) != 0 {
+		t.Fatal(rotated.Errors)
+	}
+
+	if rotated.Data.Token == "" || rotated.Data.RefreshToken == "" {
+		t.Fatal("no tokens after refresh")
+	}
+
+	if rotated.Data.RefreshToken == login.Data.RefreshToken {
+		t.Fatal("refresh token not rotated")
+	}
+
+	//reuse of the rotated token revokes the whole family
+	resp = doRequest(url, "POST", `{"refreshToken":"`+login.Data.RefreshToken+`"}`, "")
+
+	reused.Read(resp)
+
+	if len(reused.Errors) == 0 {
+		t.Fatal("rotated refresh token accepted again")
+	}
+
+	resp = doRequest(url, "POST", `{"refreshToken":"`+rotated.Data.RefreshToken+`"}`, "")
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("token family not revoked after reuse")
+	}
+
+	return
+}
+
+//"/api/users/logout", protectAuth(actionLogout)).Methods("POST")
+func TestLogout(t *testing.T) {
+	var u UserData
+
+	login := loginAdmin(t)
+
+	resp := doRequest(Murl, "GET", "", login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl+"/logout", "POST", "", login.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl, "GET", "", login.Data.Token)
+
+	if resp.StatusCode == 200 {
+		t.Fatal("revoked token still accepted")
+	}
+
+	resp = doRequest(Murl+"/token/refresh", "POST", `{"refreshToken":"`+login.Data.RefreshToken+`"}`, "")
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("refresh token still valid after logout")
+	}
+
+	return
+}
+
+//"/api/users/logout-all", protectAuth(actionLogoutAll)).Methods("POST")
+func TestLogoutAll(t *testing.T) {
+	first := loginAdmin(t)
+	second := loginAdmin(t)
+
+	resp := doRequest(Murl+"/logout-all", "POST", "", second.Data.Token)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(Murl, "GET", "", first.Data.Token)
+
+	if resp.StatusCode == 200 {
+		t.Fatal("token of other session still accepted")
+	}
+
+	return
+}
+
+func TestAccessTokenID(t *testing.T) {
+	if len(Config.JWTSecret) == 0 {
+		Config.JWTSecret = []byte("test secret")
+	}
+
+	user := User{Email: "jti@test.t", Role: "user", Status: "active"}
+	user.ID = 1
+
+	first, claims, err := signAccessToken(&user, Config.AccessTokenTTL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _, err := signAccessToken(&user, Config.AccessTokenTTL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second || tokenID(first) == tokenID(second) {
+		t.Errorf("Tokens issued at once must differ")
+	}
+
+	if tokenID(first) != claims.Id {
+		t.Errorf("Expected jti %s, got %s", claims.Id, tokenID(first))
+	}
+
+	if tokenID(first+"x") != "" {
+		t.Errorf("Tampered token must not have a jti")
+	}
+
+	expired, _, _ := signAccessToken(&user, -Config.AccessTokenTTL, 0)
+	if tokenID(expired) != "" {
+		t.Errorf("Expired token must not have a jti")
+	}
+}
@@ -0,0 +1,426 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+// TwoFactor holds the RFC 6238 TOTP secret of a user.
+// LastStep is the last accepted time step, codes are never accepted twice.
+type TwoFactor struct {
+	gorm.Model
+	UserID   uint   `gorm:"unique;not null"`
+	Secret   string `gorm:"not null"`
+	Enabled  bool
+	LastStep int64
+}
+
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	CodeHash string `gorm:"index"`
+	UsedAt   *time.Time
+}
+
+// MFAChallenge is issued by actionLogin instead of a JWT when 2FA is enabled
+type MFAChallenge struct {
+	gorm.Model
+	UserID    uint
+	TokenHash string `gorm:"unique;not null"`
+	Attempts  int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code" valid:"required"`
+}
+
+type TwoFactorRecovery struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type LoginChallenge struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challengeToken"`
+}
+
+type LoginSecondFactor struct {
+	ChallengeToken string `json:"challengeToken" valid:"required"`
+	Code           string `json:"code" valid:"required"`
+}
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// validateTOTP checks the code against the current time step and one step
+// around it to allow for clock drift, it returns the matched step
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), totpDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpURI(secret, email string) string {
+	label := url.PathEscape(Config.TOTPIssuer + ":" + email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", Config.TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Replace(code, "-", "", -1)
+	return strings.Replace(code, " ", "", -1)
+}
+
+func genRecoveryCodes(userID uint) ([]string, error) {
+	var codes []string
+
+	tx := App.DB.Begin()
+	tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{})
+
+	for i := 0; i < Config.RecoveryCodes; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		code := strings.ToLower(base32NoPad.EncodeToString(b))[:10]
+		if err := tx.Create(&RecoveryCode{UserID: userID, CodeHash: App.ToSum256(code)}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	return codes, tx.Commit().Error
+}
+
+func useRecoveryCode(userID uint, code string) bool {
+	res := App.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, App.ToSum256(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+// verifySecondFactor accepts a fresh TOTP code or an unused recovery code
+func verifySecondFactor(tf TwoFactor, code string) bool {
+	if step, ok := validateTOTP(tf.Secret, code, time.Now()); ok {
+		res := App.DB.Model(&TwoFactor{}).
+			Where("id = ? AND last_step < ?", tf.ID, step).
+			UpdateColumn("last_step", step)
+		return res.Error == nil && res.RowsAffected == 1
+	}
+
+	return useRecoveryCode(tf.UserID, code)
+}
+
+func twoFactorEnabled(userID uint) bool {
+	var tf TwoFactor
+	App.DB.Where("user_id = ? AND enabled = ?", userID, true).First(&tf)
+	return tf.ID != 0
+}
+
+func startMFAChallenge(userID uint) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = App.DB.Create(&MFAChallenge{
+		UserID:    userID,
+		TokenHash: App.ToSum256(token),
+		ExpiresAt: time.Now().Add(Config.MFAChallengeTTL),
+	}).Error
+
+	return token, err
+}
+
+func resetTwoFactor(userID uint) error {
+	tx := App.DB.Begin()
+	tx.Unscoped().Where("user_id = ?", userID).Delete(&TwoFactor{})
+	tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{})
+	return tx.Commit().Error
+}
+
+func actionTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	var (
+		user       User
+		tf         TwoFactor
+		enrollment TwoFactorEnrollment
+		rsp        = core.Response{Data: &enrollment, Req: r}
+	)
+
+	session, ok := currentSession(r)
+	if ok {
+		App.DB.First(&user, session.UserID)
+		App.DB.Where("user_id = ?", user.ID).First(&tf)
+	}
+
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+
+	if user.ID == 0 {
+		rsp.Errors.Add("token", "User not found")
+	} else if tf.Enabled {
+		rsp.Errors.Add("code", "Two-factor authentication is already enabled")
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("code", "Secret generation error")
+		log.Println("Secret generation error: " + err.Error())
+	} else {
+		tf.UserID = user.ID
+		tf.Secret = base32NoPad.EncodeToString(secret)
+		tf.LastStep = 0
+		if res := App.DB.Save(&tf); res.Error != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			rsp.Errors.Add("code", "Data saving error")
+			log.Println("Data saving error: " + res.Error.Error())
+		} else {
+			enrollment.Secret = tf.Secret
+			enrollment.URI = totpURI(tf.Secret, user.Email)
+		}
+	}
+
+	rsp.Data = &enrollment
+
+	w.Write(rsp.Make())
+}
+
+func actionTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	var (
+		data     TwoFactorCode
+		tf       TwoFactor
+		recovery TwoFactorRecovery
+		rsp      = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			session, ok := currentSession(r)
+			if ok {
+				App.DB.Where("user_id = ?", session.UserID).First(&tf)
+			}
+
+			if tf.ID == 0 {
+				rsp.Errors.Add("code", "Two-factor enrollment not started")
+			} else if tf.Enabled {
+				rsp.Errors.Add("code", "Two-factor authentication is already enabled")
+			} else if step, valid := validateTOTP(tf.Secret, data.Code, time.Now()); !valid {
+				rsp.Errors.Add("code", "Wrong code")
+			} else if codes, err := genRecoveryCodes(tf.UserID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("code", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				App.DB.Model(&tf).Updates(map[string]interface{}{"enabled": true, "last_step": step})
+				recovery.RecoveryCodes = codes
+				rsp.Data = &recovery
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	var (
+		data TwoFactorCode
+		tf   TwoFactor
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			session, ok := currentSession(r)
+			if ok {
+				App.DB.Where("user_id = ? AND enabled = ?", session.UserID, true).First(&tf)
+			}
+
+			if tf.ID == 0 {
+				rsp.Errors.Add("code", "Two-factor authentication is not enabled")
+			} else if !verifySecondFactor(tf, data.Code) {
+				rsp.Errors.Add("code", "Wrong code")
+			} else if err := resetTwoFactor(tf.UserID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("code", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			}
+		}
+	}
+
+	data.Code = ""
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
+
+func actionTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var (
+		data     TwoFactorCode
+		tf       TwoFactor
+		recovery TwoFactorRecovery
+		rsp      = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			session, ok := currentSession(r)
+			if ok {
+				App.DB.Where("user_id = ? AND enabled = ?", session.UserID, true).First(&tf)
+			}
+
+			if tf.ID == 0 {
+				rsp.Errors.Add("code", "Two-factor authentication is not enabled")
+			} else if !verifySecondFactor(tf, data.Code) {
+				rsp.Errors.Add("code", "Wrong code")
+			} else if codes, err := genRecoveryCodes(tf.UserID); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("code", "Data saving error")
+				log.Println("Data saving error: " + err.Error())
+			} else {
+				recovery.RecoveryCodes = codes
+				rsp.Data = &recovery
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionLoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var (
+		data      LoginSecondFactor
+		challenge MFAChallenge
+		tf        TwoFactor
+		user      User
+		rsp       = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			App.DB.Where("token_hash = ?", App.ToSum256(data.ChallengeToken)).First(&challenge)
+			App.DB.Where("user_id = ? AND enabled = ?", challenge.UserID, true).First(&tf)
+			App.DB.Preload("Profile").First(&user, challenge.UserID)
+
+			if challenge.ID == 0 || challenge.UsedAt != nil || challenge.ExpiresAt.Before(time.Now()) ||
+				challenge.Attempts >= Config.MFAMaxAttempts || tf.ID == 0 || user.ID == 0 {
+				rsp.Errors.Add("challengeToken", "Challenge is not valid, please log in again")
+			} else if res := App.DB.Model(&MFAChallenge{}).
+				Where("id = ? AND attempts < ?", challenge.ID, Config.MFAMaxAttempts).
+				UpdateColumn("attempts", gorm.Expr("attempts + 1")); res.Error != nil || res.RowsAffected != 1 {
+				//the attempt is taken before the code is checked, so parallel guesses can not overrun the limit
+				rsp.Errors.Add("challengeToken", "Challenge is not valid, please log in again")
+			} else if !checkLoginLocks(w, &rsp, r, user.Email) {
+				//checkLoginLocks has set the error
+			} else if !verifySecondFactor(tf, data.Code) {
+				//wrong codes count towards the lockout of the account like wrong passwords
+				recordLoginFailure(r, user, user.Email)
+				rsp.Errors.Add("code", "Wrong code")
+			} else {
+				releaseLoginLocks(r, user.Email)
+
+				if res := App.DB.Model(&MFAChallenge{}).
+					Where("id = ? AND used_at IS NULL", challenge.ID).
+					Update("used_at", time.Now()); res.RowsAffected != 1 {
+					rsp.Errors.Add("challengeToken", "Challenge is not valid, please log in again")
+				} else if passwordExpired(user) {
+					expired := expiredPasswordChange(w, &rsp, user)
+					rsp.Data = &expired
+				} else if err := genTokens(r, &user, ""); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("code", "Error generating JWT token: "+err.Error())
+				} else {
+					unlockLogin(user.Email)
+					w.Header().Set("Authorization", "Bearer "+user.Token)
+					user.Password = ""
+					rsp.Data = &user
+				}
+			}
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+func actionTwoFactorReset(w http.ResponseWriter, r *http.Request) {
+	var (
+		user User
+		rsp  = core.Response{Data: &user, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	App.DB.First(&user, vars["id"])
+
+	if user.ID == 0 {
+		rsp.Errors.Add("ID", "User not found")
+	} else if err := resetTwoFactor(user.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		rsp.Errors.Add("ID", "Data saving error")
+		log.Println("Data saving error: " + err.Error())
+	}
+
+	user.Password = ""
+	rsp.Data = &user
+
+	w.Write(rsp.Make())
+}
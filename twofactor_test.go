@@ -0,0 +1,67 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotp(t *testing.T) {
+	//RFC 6238 appendix B, SHA1
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		name string
+		time int64
+		want string
+	}{
+		{"59", 59, "94287082"},
+		{"1111111109", 1111111109, "07081804"},
+		{"1111111111", 1111111111, "14050471"},
+		{"1234567890", 1234567890, "89005924"},
+		{"2000000000", 2000000000, "69279037"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hotp(key, uint64(tt.time/totpPeriod), 8); got != tt.want {
+				t.Errorf("hotp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := base32NoPad.EncodeToString(key)
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	code := hotp(key, uint64(step), totpDigits)
+
+	if got, ok := validateTOTP(secret, code, now); !ok || got != step {
+		t.Errorf("current code rejected")
+	}
+
+	if _, ok := validateTOTP(strings.ToLower(secret), code, now.Add(totpPeriod*time.Second)); !ok {
+		t.Errorf("code from previous step rejected")
+	}
+
+	if _, ok := validateTOTP(secret, code, now.Add(3*totpPeriod*time.Second)); ok {
+		t.Errorf("outdated code accepted")
+	}
+
+	if _, ok := validateTOTP(secret, "12345", now); ok {
+		t.Errorf("short code accepted")
+	}
+}
+
+func TestTotpURI(t *testing.T) {
+	uri := totpURI("JBSWY3DPEHPK3PXP", "user@test.t")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/") {
+		t.Fatalf("wrong uri scheme %s", uri)
+	}
+
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("secret missing in %s", uri)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
@@ -15,31 +14,42 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 )
 
-var App core.App
+var (
+	App           core.App
+	resendByEmail *Throttle
+	resendByIP    *Throttle
+	magicByEmail  *Throttle
+	magicByIP     *Throttle
+)
 
 type Users []User
 
 type User struct {
 	gorm.Model
-	Email       string        `json:"email" gorm:"unique;not null" valid:"email,required,unique~email: Email not unique"`
-	Password    string        `json:"password" valid:"ascii,required,passcomplexity~password: Password must be at least 8 characters long and contain letters & uppercase letters & numbers & foam marks"`
-	RePassword  string        `gorm:"-" json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
-	Role        string        `json:"role" valid:"in(candidate|user|admin)"`
-	Status      string        `json:"status" valid:"in(active|blocked|draft)"`
-	Token       string        `json:"token"`
-	Salt        string        `json:"-"`
-	CheckToken  string        `json:"-"`
-	CallBackUrl string        `gorm:"-"`
-	Profile     Profile       `json:"profile"`
-	ProfileID   int           `json:"profileID"`
-	Keywords    []UserKeyword `json:"keywords" gorm:"many2many:userkeywords"`
+	Email        string        `json:"email" gorm:"unique;not null" valid:"email,required,unique~email: Email not unique"`
+	Password     string        `json:"password" valid:"ascii,required"`
+	RePassword   string        `gorm:"-" json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
+	Role         string        `json:"role" valid:"rolename~role: Role not found"`
+	Status       string        `json:"status" valid:"in(active|blocked|draft)"`
+	Token        string        `json:"token"`
+	RefreshToken string        `gorm:"-" json:"refreshToken,omitempty"`
+	Salt         string        `json:"-"`
+	LegacyHash   bool          `json:"-"`
+	CallBackUrl  string        `gorm:"-"`
+	Profile      Profile       `json:"profile"`
+	ProfileID    int           `json:"profileID"`
+	Keywords     []UserKeyword `json:"keywords" gorm:"many2many:userkeywords"`
+	Roles        []Role        `json:"roles,omitempty" gorm:"many2many:user_roles"`
+	Memberships  []Membership  `json:"memberships,omitempty"`
+
+	// PasswordChangedAt is compared with Config.MaxPasswordAge on login
+	PasswordChangedAt *time.Time `json:"-"`
 }
 
 type UserUpdate struct {
-	Password   string  `json:"password" valid:"ascii,passcomplexity~password: Password must be at least 8 characters long and contain letters & uppercase letters & numbers & foam marks"`
+	Password   string  `json:"password" valid:"ascii"`
 	RePassword string  `json:"repassword" valid:"ascii,passmatch~repassword: Passwords do not match"`
-	Role       string  `json:"role"`
-	Salt       string  `json:"-"`
+	Role       string  `json:"role" valid:"rolename~role: Role not found"`
 	Status     string  `json:"status" valid:"required,in(active|blocked|draft)"`
 	Profile    Profile `json:"profile"`
 }
@@ -53,6 +63,11 @@ type Confirm struct {
 	CheckToken string `json:"checkToken" valid:"required"`
 }
 
+type ConfirmResend struct {
+	Email       string `json:"email" valid:"email,required"`
+	CallBackUrl string `json:"callBackUrl"`
+}
+
 type ResetRequest struct {
 	Email       string `json:"email" valid:"email,required"`
 	CallBackUrl string `json:"callBackUrl"`
@@ -60,7 +75,7 @@ type ResetRequest struct {
 
 type Reset struct {
 	CheckToken string `json:"checkToken" valid:"required"`
-	Password   string `json:"password" valid:"ascii,required,passcomplexity~password: Password must be at least 8 characters long and contain letters & uppercase letters & numbers & foam marks"`
+	Password   string `json:"password" valid:"ascii,required"`
 	RePassword string `gorm:"-" json:"repassword" valid:"ascii,required,passmatch~repassword: Passwords do not match"`
 }
 
@@ -79,51 +94,178 @@ func init() {
 			if i == v.Password {
 				return true
 			}
+		case PasswordChange:
+			if i == v.Password {
+				return true
+			}
+		case InviteRegister:
+			if i == v.Password {
+				return true
+			}
+		case ExpiredPasswordChange:
+			if i == v.Password {
+				return true
+			}
 		}
 		return false
 	}))
+	//kept for structs outside this module, personal data is not checked here
 	govalidator.TagMap["passcomplexity"] = govalidator.Validator(func(str string) bool {
-		var valid1 = regexp.MustCompile(`\W+|_`)
-		var valid2 = regexp.MustCompile(`[a-z]`)
-		var valid3 = regexp.MustCompile(`[0-9]`)
-		var valid4 = regexp.MustCompile(`[A-Z]`)
-
-		var chk1 = len(valid1.FindAllStringSubmatch(str, -1))
-		var chk2 = len(valid2.FindAllStringSubmatch(str, -1))
-		var chk3 = len(valid3.FindAllStringSubmatch(str, -1))
-		var chk4 = len(valid4.FindAllStringSubmatch(str, -1))
-
-		if len(str) < 8 || chk1 < 1 || chk2 < 1 || chk3 < 1 || chk4 < 1 {
-			return false
-		}
-
-		return true
+		return len(Config.PasswordPolicy.Check(str)) == 0
 	})
 }
 
 func Configure(a core.App) {
 	App = a
 
-	App.DB.Debug().AutoMigrate(&User{}, &Profile{}, &UserKeyword{})
+	App.DB.Debug().AutoMigrate(
+		&User{},
+		&Profile{},
+		&UserKeyword{},
+		&RefreshToken{},
+		&RevokedToken{},
+		&Session{},
+		&TwoFactor{},
+		&RecoveryCode{},
+		&MFAChallenge{},
+		&VerificationToken{},
+		&Role{},
+		&Permission{},
+		&Organization{},
+		&Membership{},
+		&Invitation{},
+		&AuditLog{},
+		&APIKey{},
+		&LoginAttempt{},
+		&PasswordHistory{},
+	)
+
+	if len(Config.JWTSecret) == 0 {
+		log.Fatal("Config.JWTSecret is not set")
+	}
+
+	if !validHasher(Config.PasswordHasher) {
+		log.Fatalf("Config.PasswordHasher must be \"bcrypt\" or \"argon2id\", not %q", Config.PasswordHasher)
+	}
+
+	proxies, err := parseTrustedProxies(Config.TrustedProxies)
+	if err != nil {
+		log.Fatal("Trusted proxies error: " + err.Error())
+	}
+	trustedProxies = proxies
+
+	if err := loadPasswordBlocklist(); err != nil {
+		log.Fatal("Password blocklist error: " + err.Error())
+	}
+
+	flagLegacyPasswords()
+	migratePasswordChangedAt()
+	migrateKeywordSlugs()
+	migrateCheckTokens()
+	seedRoles()
+	startTokenCleanup()
+
+	resendByEmail = NewThrottle(Config.ResendPerEmail, Config.ResendWindow)
+	resendByIP = NewThrottle(Config.ResendPerIP, Config.ResendWindow)
+	magicByEmail = NewThrottle(Config.ResendPerEmail, Config.ResendWindow)
+	magicByIP = NewThrottle(Config.ResendPerIP, Config.ResendWindow)
+	loginLocks = newLockStore(Config.LockStore)
+	avatarStore = newBlobStore()
+	if Config.AvatarStore == nil {
+		serveAvatars()
+	}
+	if Config.MigrateAvatars {
+		migrateAvatars()
+	}
 
 	createAdmin()
 	createTestUser()
 
 	//public actions
 	App.R.HandleFunc("/users/register", actionRegister).Methods("POST")
+	App.R.HandleFunc("/users/register/invite", actionRegisterInvite).Methods("POST")
 	App.R.HandleFunc("/users/login", actionLogin).Methods("POST")
+	App.R.HandleFunc("/users/login/2fa", actionLoginSecondFactor).Methods("POST")
+	App.R.HandleFunc("/users/login/unlock", actionUnlock).Methods("POST")
 	App.R.HandleFunc("/users/confirm", actionConfirm).Methods("POST")
+	App.R.HandleFunc("/users/confirm/resend", actionConfirmResend).Methods("POST")
 	App.R.HandleFunc("/users/resetrequest", actionResetrequest).Methods("POST")
 	App.R.HandleFunc("/users/reset", actionReset).Methods("POST")
+	App.R.HandleFunc("/users/password/expired", actionPasswordExpired).Methods("POST")
+	App.R.HandleFunc("/users/token/refresh", actionTokenRefresh).Methods("POST")
+	App.R.HandleFunc("/users/magiclink", actionMagicLink).Methods("POST")
+	App.R.HandleFunc("/users/magiclink/verify", actionMagicLinkVerify).Methods("POST")
+	App.R.HandleFunc("/users/email/confirm", actionEmailChangeConfirm).Methods("POST")
+	App.R.HandleFunc("/users/email/revert", actionEmailChangeRevert).Methods("POST")
+	App.R.HandleFunc("/users/orgs/invitations/accept", actionInvitationAccept).Methods("POST")
 
-	App.R.HandleFunc("/users/{id}/profile", actionGetProfile).Methods("GET")
+	//user ids are numeric, so /users/keywords and the like never match /users/{id}
+	App.R.HandleFunc("/users/{id:[0-9]+}/profile", actionGetProfile).Methods("GET")
 
 	//protect actions
-	App.R.HandleFunc("/users", App.Protect(actionGetAll, []string{"admin"})).Methods("GET")
-	App.R.HandleFunc("/users/{id}", App.Protect(actionGetOne, []string{"admin"})).Methods("GET")
-	App.R.HandleFunc("/users", App.Protect(actionCreate, []string{"admin"})).Methods("POST")
-	App.R.HandleFunc("/users/{id}", App.Protect(actionUpdate, []string{"admin"})).Methods("PATCH")
-	App.R.HandleFunc("/users/{id}", App.Protect(actionDelete, []string{"admin"})).Methods("DELETE")
+	App.R.HandleFunc("/users/logout", protectAuth(actionLogout)).Methods("POST")
+	App.R.HandleFunc("/users/logout-all", protectAuth(actionLogoutAll)).Methods("POST")
+	App.R.HandleFunc("/users/me", protectAuth(actionMeGet)).Methods("GET")
+	App.R.HandleFunc("/users/me", protectAuth(actionMeUpdate)).Methods("PATCH")
+	App.R.HandleFunc("/users/me/profile", protectAuth(actionMeProfileUpdate)).Methods("PATCH")
+	App.R.HandleFunc("/users/me/password", protectOwner(actionMePassword)).Methods("POST")
+	App.R.HandleFunc("/users/me/avatar", protectAuth(actionMeAvatarUpload)).Methods("POST")
+	App.R.HandleFunc("/users/me/email", protectOwner(actionEmailChange)).Methods("POST")
+	App.R.HandleFunc("/users/me/sessions", protectAuth(actionMySessions)).Methods("GET")
+	App.R.HandleFunc("/users/me/sessions/{sid}", protectAuth(actionMySessionDelete)).Methods("DELETE")
+	App.R.HandleFunc("/users/me/apikeys", protectAuth(actionAPIKeyGetAll)).Methods("GET")
+	App.R.HandleFunc("/users/me/apikeys", protectOwner(actionAPIKeyCreate)).Methods("POST")
+	App.R.HandleFunc("/users/me/apikeys/{kid}", protectAuth(actionAPIKeyDelete)).Methods("DELETE")
+	App.R.HandleFunc("/users/me/2fa/enroll", protectOwner(actionTwoFactorEnroll)).Methods("POST")
+	App.R.HandleFunc("/users/me/2fa/confirm", protectOwner(actionTwoFactorConfirm)).Methods("POST")
+	App.R.HandleFunc("/users/me/2fa/disable", protectOwner(actionTwoFactorDisable)).Methods("POST")
+	App.R.HandleFunc("/users/me/2fa/recovery-codes", protectOwner(actionTwoFactorRecoveryCodes)).Methods("POST")
+	App.R.HandleFunc("/users/invitations", protectAuth(actionInvitationCreate)).Methods("POST")
+	App.R.HandleFunc("/users/invitations", ProtectPermission(actionInvitationGetAll, "users.create")).Methods("GET")
+	App.R.HandleFunc("/users/invitations/{id}", ProtectPermission(actionInvitationDelete, "users.create")).Methods("DELETE")
+	App.R.HandleFunc("/users/orgs", protectAuth(actionOrgGetAll)).Methods("GET")
+	App.R.HandleFunc("/users/orgs", protectAuth(actionOrgCreate)).Methods("POST")
+	App.R.HandleFunc("/users/orgs/{id}", protectAuth(actionOrgGetOne)).Methods("GET")
+	App.R.HandleFunc("/users/orgs/{id}", protectAuth(actionOrgUpdate)).Methods("PATCH")
+	App.R.HandleFunc("/users/orgs/{id}", protectAuth(actionOrgDelete)).Methods("DELETE")
+	App.R.HandleFunc("/users/orgs/{id}/members", protectAuth(actionOrgUserGetAll)).Methods("GET")
+	App.R.HandleFunc("/users/orgs/{id}/members", protectAuth(actionOrgMemberInvite)).Methods("POST")
+	App.R.HandleFunc("/users/orgs/{id}/members/{uid}", protectAuth(actionOrgMemberUpdate)).Methods("PATCH")
+	App.R.HandleFunc("/users/orgs/{id}/members/{uid}", protectAuth(actionOrgMemberDelete)).Methods("DELETE")
+	App.R.HandleFunc("/users/{id:[0-9]+}/2fa", ProtectPermission(actionTwoFactorReset, "users.2fa")).Methods("DELETE")
+	App.R.HandleFunc("/users/{id:[0-9]+}/sessions", ProtectPermission(actionUserSessions, "users.sessions")).Methods("GET")
+	App.R.HandleFunc("/users/{id:[0-9]+}/sessions", ProtectPermission(actionUserSessionsDelete, "users.sessions")).Methods("DELETE")
+	App.R.HandleFunc("/users/{id:[0-9]+}/sessions/{sid}", ProtectPermission(actionUserSessionDelete, "users.sessions")).Methods("DELETE")
+	App.R.HandleFunc("/users/roles", ProtectPermission(actionRoleGetAll, "roles.read")).Methods("GET")
+	App.R.HandleFunc("/users/roles/{id}", ProtectPermission(actionRoleGetOne, "roles.read")).Methods("GET")
+	App.R.HandleFunc("/users/roles", ProtectPermission(actionRoleCreate, "roles.manage")).Methods("POST")
+	App.R.HandleFunc("/users/roles/{id}", ProtectPermission(actionRoleUpdate, "roles.manage")).Methods("PATCH")
+	App.R.HandleFunc("/users/roles/{id}", ProtectPermission(actionRoleDelete, "roles.manage")).Methods("DELETE")
+	App.R.HandleFunc("/users/permissions", ProtectPermission(actionPermissionGetAll, "roles.read")).Methods("GET")
+	App.R.HandleFunc("/users/permissions", ProtectPermission(actionPermissionCreate, "roles.manage")).Methods("POST")
+	App.R.HandleFunc("/users/permissions/{id}", ProtectPermission(actionPermissionDelete, "roles.manage")).Methods("DELETE")
+	App.R.HandleFunc("/users/{id:[0-9]+}/avatar", ProtectPermission(actionAvatarUpload, "users.update")).Methods("POST")
+	App.R.HandleFunc("/users/{id:[0-9]+}/roles", ProtectPermission(actionUserRoles, "roles.manage")).Methods("PUT")
+	App.R.HandleFunc("/users/audit", ProtectPermission(actionAuditLog, "users.audit")).Methods("GET")
+	App.R.HandleFunc("/users/{id:[0-9]+}/unlock", ProtectPermission(actionUserUnlock, "users.update")).Methods("POST")
+	App.R.HandleFunc("/users/{id:[0-9]+}/impersonate", ProtectPermission(actionImpersonate, "users.impersonate")).Methods("POST")
+	App.R.HandleFunc("/users/keywords", ProtectPermission(actionKeywordGetAll, "users.read")).Methods("GET")
+	App.R.HandleFunc("/users/keywords/tree", ProtectPermission(actionKeywordTree, "users.read")).Methods("GET")
+	App.R.HandleFunc("/users/keywords/{id}", ProtectPermission(actionKeywordGetOne, "users.read")).Methods("GET")
+	App.R.HandleFunc("/users/keywords", ProtectPermission(actionKeywordCreate, "users.keywords")).Methods("POST")
+	App.R.HandleFunc("/users/keywords/{id}", ProtectPermission(actionKeywordUpdate, "users.keywords")).Methods("PATCH")
+	App.R.HandleFunc("/users/keywords/{id}", ProtectPermission(actionKeywordDelete, "users.keywords")).Methods("DELETE")
+	App.R.HandleFunc("/users/keywords/{id}/move", ProtectPermission(actionKeywordMove, "users.keywords")).Methods("POST")
+	App.R.HandleFunc("/users/keywords/{id}/merge", ProtectPermission(actionKeywordMerge, "users.keywords")).Methods("POST")
+	App.R.HandleFunc("/users/{id:[0-9]+}/keywords", ProtectPermission(actionUserKeywordsReplace, "users.update")).Methods("PUT")
+	App.R.HandleFunc("/users/{id:[0-9]+}/keywords/{keywordId:[0-9]+}", ProtectPermission(actionUserKeywordAdd, "users.update")).Methods("PUT")
+	App.R.HandleFunc("/users/{id:[0-9]+}/keywords/{keywordId:[0-9]+}", ProtectPermission(actionUserKeywordDelete, "users.update")).Methods("DELETE")
+	App.R.HandleFunc("/users/passwords/stats", ProtectPermission(actionPasswordStats, "users.passwords")).Methods("GET")
+	App.R.HandleFunc("/users", ProtectPermission(actionGetAll, "users.read")).Methods("GET")
+	App.R.HandleFunc("/users/{id:[0-9]+}", ProtectPermission(actionGetOne, "users.read")).Methods("GET")
+	App.R.HandleFunc("/users", ProtectPermission(actionCreate, "users.create")).Methods("POST")
+	App.R.HandleFunc("/users/{id:[0-9]+}", ProtectPermission(actionUpdate, "users.update")).Methods("PATCH")
+	App.R.HandleFunc("/users/{id:[0-9]+}", ProtectPermission(actionDelete, "users.delete")).Methods("DELETE")
 }
 
 func actionGetOne(w http.ResponseWriter, r *http.Request) {
@@ -133,7 +275,7 @@ func actionGetOne(w http.ResponseWriter, r *http.Request) {
 	)
 
 	vars := mux.Vars(r)
-	App.DB.Preload("Profile").First(&user, vars["id"])
+	App.DB.Preload("Profile").Preload("Roles").Preload("Keywords").First(&user, vars["id"])
 
 	if user.ID == 0 {
 		rsp.Errors.Add("ID", "User not found")
@@ -145,6 +287,12 @@ func actionGetOne(w http.ResponseWriter, r *http.Request) {
 }
 
 func actionGetAll(w http.ResponseWriter, r *http.Request) {
+	findUsers(w, r, App.DB)
+}
+
+// findUsers writes the filtered, sorted and paged list of users
+// selected by db, tenant scoped lists pass a narrowed db
+func findUsers(w http.ResponseWriter, r *http.Request, db *gorm.DB) {
 	var (
 		users  Users
 		count  int64
@@ -156,10 +304,10 @@ func actionGetAll(w http.ResponseWriter, r *http.Request) {
 		status = r.FormValue("status")
 		name   = r.FormValue("name")
 		phone  = r.FormValue("phone")
+		kwords = parseKeywordFilter(r)
 		sort   = r.FormValue("sort")
 		limit  = r.FormValue("limit")
 		offset = r.FormValue("offset")
-		db     = App.DB
 	)
 
 	db = db.Select(`
@@ -177,14 +325,18 @@ func actionGetAll(w http.ResponseWriter, r *http.Request) {
 	db = db.Joins("LEFT JOIN profiles ON users.profile_id = profiles.id")
 
 	if all != "" {
-		db = db.Where("users.id LIKE ?", "%"+all+"%")
-		db = db.Or("users.email LIKE ?", "%"+all+"%")
-		db = db.Or("users.role LIKE ?", "%"+all+"%")
-		db = db.Or("users.status LIKE ?", "%"+all+"%")
-		db = db.Or("profiles.firstname LIKE ?", "%"+all+"%")
-		db = db.Or("profiles.lastname LIKE ?", "%"+all+"%")
-		db = db.Or("profiles.middlename LIKE ?", "%"+all+"%")
-		db = db.Or("profiles.phone LIKE ?", "%"+all+"%")
+		//grouped in one condition so the OR can not escape a tenant scope
+		db = db.Where(`
+			users.id LIKE ?
+			OR users.email LIKE ?
+			OR users.role LIKE ?
+			OR users.status LIKE ?
+			OR profiles.firstname LIKE ?
+			OR profiles.lastname LIKE ?
+			OR profiles.middlename LIKE ?
+			OR profiles.phone LIKE ?`,
+			"%"+all+"%", "%"+all+"%", "%"+all+"%", "%"+all+"%",
+			"%"+all+"%", "%"+all+"%", "%"+all+"%", "%"+all+"%")
 	}
 
 	if id != "" {
@@ -218,6 +370,8 @@ func actionGetAll(w http.ResponseWriter, r *http.Request) {
 		db = db.Where("profiles.phone LIKE ?", "%"+phone+"%")
 	}
 
+	db = filterByKeywords(db, kwords)
+
 	if sort != "" {
 		switch sort {
 		case "id":
@@ -276,13 +430,22 @@ func actionCreate(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if rsp.IsJsonParseDone(r.Body) {
-		if rsp.IsValidate() {
-			curtime := fmt.Sprintf("%x", time.Now())
-			passsalt := App.ToSum256(curtime)
-			passhash := App.ToSum256(user.Password + passsalt)
-			user.Password = passhash
-			user.Salt = passsalt
-			App.DB.Create(&user)
+		if rsp.IsValidate() && checkPasswordPolicy(&rsp, user.Password, user) {
+			//additional roles are set through /users/{id}/roles only
+			user.Roles = nil
+
+			if user.Role != "" && !canAssignRoles(r) {
+				w.WriteHeader(http.StatusForbidden)
+				rsp.Errors.Add("role", "Permission denied: roles.manage")
+			} else if passhash, err := hashPassword(user.Password); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("password", "Password hashing error")
+				log.Println("Password hashing error: " + err.Error())
+			} else {
+				user.Password = passhash
+				App.DB.Create(&user)
+				recordPassword(user.ID, passhash)
+			}
 		}
 	}
 
@@ -302,23 +465,48 @@ func actionUpdate(w http.ResponseWriter, r *http.Request) {
 		if rsp.IsValidate() {
 
 			vars := mux.Vars(r)
-			App.DB.First(&user, vars["id"])
+			App.DB.Preload("Profile").First(&user, vars["id"])
 
 			if user.ID == 0 {
 				rsp.Errors.Add("ID", "User not found")
+			} else if data.Role != "" && data.Role != user.Role && !canAssignRoles(r) {
+				w.WriteHeader(http.StatusForbidden)
+				rsp.Errors.Add("role", "Permission denied: roles.manage")
+			} else if data.Password != "" && data.RePassword != data.Password {
+				//passmatch is skipped for an empty repassword
+				rsp.Errors.Add("repassword", "Passwords do not match")
+			} else if data.Password != "" && !checkPasswordPolicy(&rsp, data.Password, user) {
+				//checkPasswordPolicy has set the errors
+			} else if data.Password != "" && passwordReused(user, data.Password) {
+				rsp.Errors.Add("password", "Password was used recently")
 			} else {
-				if data.Password != "" && data.RePassword != "" {
-					curtime := fmt.Sprintf("%x", time.Now())
-					passsalt := App.ToSum256(curtime)
-					passhash := App.ToSum256(data.Password + passsalt)
+				var (
+					passhash string
+					err      error
+				)
+				if data.Password != "" {
+					passhash, err = hashPassword(data.Password)
 					data.Password = passhash
-					data.Salt = passsalt
 				}
-				App.DB.Model(&user).Updates(data)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("password", "Password hashing error")
+					log.Println("Password hashing error: " + err.Error())
+				} else {
+					App.DB.Model(&user).Updates(data)
+					if data.Status == "blocked" {
+						revokeUserTokens(user.ID)
+					}
+					if passhash != "" {
+						App.DB.Model(&user).Updates(map[string]interface{}{"salt": "", "legacy_hash": false})
+						recordPassword(user.ID, passhash)
+					}
+				}
 			}
 		}
 	}
 
+	user.Password = ""
 	rsp.Data = &user
 
 	w.Write(rsp.Make())
@@ -338,6 +526,7 @@ func actionDelete(w http.ResponseWriter, r *http.Request) {
 	if user.ID == 0 {
 		rsp.Errors.Add("ID", "User not found")
 	} else {
+		revokeUserTokens(user.ID)
 		if App.IsTest {
 			App.DB.Unscoped().Delete(&user)
 			App.DB.Unscoped().Delete(&profile)
@@ -354,28 +543,48 @@ func actionDelete(w http.ResponseWriter, r *http.Request) {
 
 func actionLogin(w http.ResponseWriter, r *http.Request) {
 	var (
-		data Login
-		user User
-		rsp  = core.Response{Data: &data, Req: r}
+		data      Login
+		user      User
+		challenge LoginChallenge
+		expired   PasswordExpired
+		rsp       = core.Response{Data: &data, Req: r}
 	)
 
 	if rsp.IsJsonParseDone(r.Body) {
 		if rsp.IsValidate() {
 			App.DB.Preload("Profile").Where("email = ?", data.Email).First(&user)
-			if user.ID == 0 || user.Password != App.ToSum256(data.Password+user.Salt) {
+			if !checkLoginLocks(w, &rsp, r, data.Email) {
+				//checkLoginLocks has set the error
+			} else if user.ID == 0 || !checkPassword(user, data.Password) {
+				recordLoginFailure(r, user, data.Email)
 				rsp.Errors.Add("email", "User not found or wrong password")
-			} else if user.Role == "" || user.Role == "candidate" {
-				rsp.Errors.Add("email", "You have not verified your email address")
 			} else {
-				idstring := fmt.Sprintf("%d", user.ID)
-				token, err := App.GenToken(&idstring, &user.Email, &user.Role, &user.Status)
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					rsp.Errors.Add("email", "Error generating JWT token: "+err.Error())
+				releaseLoginLocks(r, data.Email)
+				rehashPassword(user, data.Password)
+				if user.Role == "" || user.Role == "candidate" {
+					rsp.Errors.Add("email", "You have not verified your email address")
+				} else if twoFactorEnabled(user.ID) {
+					//an expired password is handled after the second factor, see actionLoginSecondFactor
+					token, err := startMFAChallenge(user.ID)
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						rsp.Errors.Add("email", "Error generating challenge token: "+err.Error())
+					} else {
+						challenge.MFARequired = true
+						challenge.ChallengeToken = token
+					}
+				} else if passwordExpired(user) {
+					expired = expiredPasswordChange(w, &rsp, user)
 				} else {
-					w.Header().Set("Authorization", "Bearer "+token)
-					w.WriteHeader(http.StatusOK)
-					user.Token = token
+					if err := genTokens(r, &user, ""); err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						rsp.Errors.Add("email", "Error generating JWT token: "+err.Error())
+					} else {
+						//the failures are only forgiven once the user is fully signed in
+						unlockLogin(user.Email)
+						w.Header().Set("Authorization", "Bearer "+user.Token)
+						w.WriteHeader(http.StatusOK)
+					}
 				}
 			}
 		}
@@ -384,6 +593,14 @@ func actionLogin(w http.ResponseWriter, r *http.Request) {
 	user.Password = ""
 	rsp.Data = &user
 
+	if challenge.MFARequired {
+		rsp.Data = &challenge
+	}
+
+	if expired.PasswordExpired {
+		rsp.Data = &expired
+	}
+
 	w.Write(rsp.Make())
 }
 
@@ -401,30 +618,40 @@ func actionRegister(w http.ResponseWriter, r *http.Request) {
 		return true
 	})
 
+	if Config.InviteOnly {
+		w.WriteHeader(http.StatusForbidden)
+		rsp.Errors.Add("email", "Registration is by invitation only")
+		w.Write(rsp.Make())
+		return
+	}
+
 	if rsp.IsJsonParseDone(r.Body) {
-		if rsp.IsValidate() {
-			var checktoken string
-			curtime := fmt.Sprintf("%x", time.Now())
-			passsalt := App.ToSum256(curtime)
-			passhash := App.ToSum256(user.Password + passsalt)
-			if App.IsTest {
-				checktoken = "testchecktoken"
+		if rsp.IsValidate() && checkPasswordPolicy(&rsp, user.Password, user) {
+			passhash, err := hashPassword(user.Password)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				rsp.Errors.Add("password", "Password hashing error")
+				log.Println("Password hashing error: " + err.Error())
 			} else {
-				checktoken = App.ToSum256(fmt.Sprintf("%s.%x", user.Email, time.Now()))
+				user.Password = passhash
+				user.Role = "candidate"
+				user.Status = "draft"
+				App.DB.Create(&user)
+				recordPassword(user.ID, passhash)
+				checktoken, err := issueVerificationToken(user.ID, PurposeConfirm, "")
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("email", "Data saving error")
+					log.Println("Data saving error: " + err.Error())
+				} else {
+					App.Mail.Send(
+						user.Email,
+						"Registration confirm",
+						"To confirm the registration, go to the link "+user.CallBackUrl+"?token="+checktoken,
+					)
+					fmt.Println("To confirm the registration, go to the link " + user.CallBackUrl + "?token=" + checktoken)
+				}
 			}
-			user.Password = passhash
-			user.Salt = passsalt
-			user.Role = "candidate"
-			user.Status = "draft"
-			user.CheckToken = checktoken
-			log.Println(checktoken)
-			App.DB.Create(&user)
-			App.Mail.Send(
-				user.Email,
-				"Registration confirm",
-				"To confirm the registration, go to the link "+user.CallBackUrl+"?token="+checktoken,
-			)
-			fmt.Println("To confirm the registration, go to the link " + user.CallBackUrl + "?token=" + checktoken)
 		}
 	}
 
@@ -444,16 +671,18 @@ func actionConfirm(w http.ResponseWriter, r *http.Request) {
 
 	if rsp.IsJsonParseDone(r.Body) {
 		if rsp.IsValidate() {
-			App.DB.Where("check_token = ?", data.CheckToken).First(&user)
+			token, ok := useVerificationToken(data.CheckToken, PurposeConfirm)
+			if ok {
+				App.DB.First(&user, token.UserID)
+			}
 			if user.ID == 0 {
 				rsp.Errors.Add("CheckToken", "User not found")
 			} else if user.Role != "" && user.Role != "candidate" {
 				rsp.Errors.Add("CheckToken", "You have already verified your email")
 			} else {
 				res := App.DB.Model(&user).Updates(map[string]interface{}{
-					"role":        "user",
-					"status":      "active",
-					"check_token": "",
+					"role":   "user",
+					"status": "active",
 				})
 				if res.Error != nil {
 					w.WriteHeader(http.StatusInternalServerError)
@@ -470,6 +699,50 @@ func actionConfirm(w http.ResponseWriter, r *http.Request) {
 	w.Write(rsp.Make())
 }
 
+func actionConfirmResend(w http.ResponseWriter, r *http.Request) {
+	var (
+		data ConfirmResend
+		user User
+		rsp  = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			if !resendByIP.Allow(clientIP(r)) || !resendByEmail.Allow(strings.ToLower(data.Email)) {
+				w.WriteHeader(http.StatusTooManyRequests)
+				rsp.Errors.Add("email", "Too many requests, try again later")
+			} else {
+				App.DB.Where("email = ?", data.Email).First(&user)
+				if user.ID == 0 {
+					rsp.Errors.Add("email", "User not found")
+				} else if user.Role != "" && user.Role != "candidate" {
+					rsp.Errors.Add("email", "You have already verified your email")
+				} else {
+					checktoken, err := issueVerificationToken(user.ID, PurposeConfirm, "")
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						rsp.Errors.Add("email", "Data saving error")
+						log.Println("Data saving error: " + err.Error())
+					} else {
+						App.Mail.Send(
+							user.Email,
+							"Registration confirm",
+							"To confirm the registration, go to the link "+data.CallBackUrl+"?token="+checktoken,
+						)
+						if App.IsTest {
+							log.Println("To confirm the registration, go to the link " + data.CallBackUrl + "?token=" + checktoken)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	rsp.Data = &data
+
+	w.Write(rsp.Make())
+}
+
 func actionResetrequest(w http.ResponseWriter, r *http.Request) {
 	var (
 		data ResetRequest
@@ -479,23 +752,17 @@ func actionResetrequest(w http.ResponseWriter, r *http.Request) {
 
 	if rsp.IsJsonParseDone(r.Body) {
 		if rsp.IsValidate() {
-			var checktoken string
 			App.DB.Where("email = ?", data.Email).First(&user)
 			if user.ID == 0 {
 				rsp.Errors.Add("email", "User not found")
 			} else if user.Role == "" || user.Role == "candidate" {
 				rsp.Errors.Add("email", "You have not confirmed your email")
 			} else {
-				if App.IsTest {
-					checktoken = "testchecktoken"
-				} else {
-					checktoken = App.ToSum256(fmt.Sprintf("%s.%x", user.Email, time.Now()))
-				}
-				res := App.DB.Model(&user).Update("check_token", checktoken)
-				if res.Error != nil {
+				checktoken, err := issueVerificationToken(user.ID, PurposeReset, "")
+				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					rsp.Errors.Add("email", "Data saving error")
-					log.Println("Data saving error: " + res.Error.Error())
+					log.Println("Data saving error: " + err.Error())
 				} else {
 					App.Mail.Send(
 						user.Email,
@@ -522,14 +789,37 @@ func actionReset(w http.ResponseWriter, r *http.Request) {
 
 	if rsp.IsJsonParseDone(r.Body) {
 		if rsp.IsValidate() {
-			App.DB.Where("check_token = ?", data.CheckToken).First(&user)
+			//the token is only consumed once the new password passes the policy
+			token := findVerificationToken(data.CheckToken, PurposeReset)
+			if token.ID != 0 {
+				App.DB.Preload("Profile").First(&user, token.UserID)
+			}
 			if user.ID == 0 {
 				rsp.Errors.Add("password", "User with this token is not found")
 			} else if user.Role == "" || user.Role == "candidate" {
 				rsp.Errors.Add("password", "You have already verified your email")
+			} else if !checkPasswordPolicy(&rsp, data.Password, user) {
+				//checkPasswordPolicy has set the errors
+			} else if passwordReused(user, data.Password) {
+				rsp.Errors.Add("password", "Password was used recently")
+			} else if _, ok := useVerificationToken(data.CheckToken, PurposeReset); !ok {
+				rsp.Errors.Add("password", "User with this token is not found")
 			} else {
-				passhash := App.ToSum256(data.Password + user.Salt)
-				App.DB.Model(&user).Updates(map[string]interface{}{"password": passhash, "check_token": ""})
+				passhash, err := hashPassword(data.Password)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					rsp.Errors.Add("password", "Password hashing error")
+					log.Println("Password hashing error: " + err.Error())
+				} else {
+					App.DB.Model(&user).Updates(map[string]interface{}{
+						"password":    passhash,
+						"salt":        "",
+						"legacy_hash": false,
+					})
+					recordPassword(user.ID, passhash)
+					revokeUserTokens(user.ID)
+					unlockLogin(user.Email)
+				}
 			}
 		}
 	}
@@ -549,7 +839,6 @@ func createAdmin() {
 	App.DB.Where("email = ?", user.Email).First(&user)
 	if user.ID == 0 {
 		curtime := fmt.Sprintf("%x", time.Now())
-		passsalt := App.ToSum256(curtime)
 
 		if App.IsTest {
 			user.Password = "adminpass"
@@ -559,13 +848,16 @@ func createAdmin() {
 
 		fmt.Printf("admin password: %s\n", user.Password)
 
-		passhash := App.ToSum256(user.Password + passsalt)
+		passhash, err := hashPassword(user.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 		user.Password = passhash
-		user.Salt = passsalt
 		user.Role = "admin"
 		user.Status = "active"
 		App.DB.Create(&user)
+		recordPassword(user.ID, passhash)
 	}
 }
 
@@ -579,7 +871,6 @@ func createTestUser() {
 	App.DB.Where("email = ?", user.Email).First(&user)
 	if user.ID == 0 {
 		curtime := fmt.Sprintf("%x", time.Now())
-		passsalt := App.ToSum256(curtime)
 
 		if App.IsTest {
 			user.Password = "testpass"
@@ -589,13 +880,16 @@ func createTestUser() {
 
 		fmt.Printf("testuser password: %s\n", user.Password)
 
-		passhash := App.ToSum256(user.Password + passsalt)
+		passhash, err := hashPassword(user.Password)
+		if err != nil {
+			log.Fatal(err)
+		}
 
 		user.Password = passhash
-		user.Salt = passsalt
 		user.Role = "user"
 		user.Status = "active"
 		App.DB.Create(&user)
+		recordPassword(user.ID, passhash)
 	}
 }
 
@@ -617,3 +911,26 @@ func actionGetProfile(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(rsp.Make())
 }
+
+type PasswordStats struct {
+	Total    int64 `json:"total"`
+	Legacy   int64 `json:"legacy"`
+	Bcrypt   int64 `json:"bcrypt"`
+	Argon2id int64 `json:"argon2id"`
+}
+
+func actionPasswordStats(w http.ResponseWriter, r *http.Request) {
+	var (
+		stats PasswordStats
+		rsp   = core.Response{Data: &stats, Req: r}
+	)
+
+	App.DB.Model(&User{}).Count(&stats.Total)
+	App.DB.Model(&User{}).Where("legacy_hash = ?", true).Count(&stats.Legacy)
+	App.DB.Model(&User{}).Where("password LIKE ?", "$2_$%").Count(&stats.Bcrypt)
+	App.DB.Model(&User{}).Where("password LIKE ?", "$argon2id$%").Count(&stats.Argon2id)
+
+	rsp.Data = &stats
+
+	w.Write(rsp.Make())
+}
@@ -132,6 +132,40 @@ func TestRegister(t *testing.T) {
 	return
 }
 
+//"/api/users/confirm/resend", actionConfirmResend).Methods("POST")
+func TestConfirmResend(t *testing.T) {
+
+	url := Murl + "/confirm/resend"
+	var u UserData
+
+	resp := doRequest(url, "POST", `{"email":"admin@admin.a"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("confirmation resent to verified user")
+	}
+
+	resp = doRequest(url, "POST", `{"email":"`+UEmail+`", "callBackUrl":"http://test.ttt"}`, "")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	return
+}
+
 //"/api/users/confirm", srvConfirm).Methods("POST")
 func TestConfirmEmail(t *testing.T) {
 
@@ -179,6 +213,16 @@ func TestConfirmEmail(t *testing.T) {
 		t.Fatal(u.Errors)
 	}
 
+	//tokens are single-use
+	resp = doRequest(url, "POST", userJson, "")
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("confirm token used twice")
+	}
+
 	return
 }
 
@@ -339,7 +383,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -365,7 +409,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -391,7 +435,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -416,7 +460,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -443,7 +487,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -470,7 +514,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + fake.LastName() + `",
 			"phone":"` + fake.Phone() + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -497,7 +541,7 @@ func TestCreate(t *testing.T) {
 			"middlename":"` + fake.FirstName() + `",
 			"lastname":"` + UProfileLastname + `",
 			"phone":"` + UProfilePhone + `",
-			"avatar":"00001100"
+			"avatar":"https://example.com/avatar.png"
 		}
 	}`
 
@@ -843,6 +887,20 @@ func TestUpdate(t *testing.T) {
 		t.Fatal("update dont work", u.Errors, Uidnew)
 	}
 
+	//a password without repassword must not be saved
+	resp = doRequest(url, "PATCH", `{"status":"blocked", "password":"new.PASS123"}`, AdminToken)
+
+	u = UserData{}
+	u.Read(resp)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("password accepted without repassword")
+	}
+
+	if u.Data.Password != "" {
+		t.Fatal("password hash returned")
+	}
+
 	return
 }
 
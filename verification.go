@@ -0,0 +1,178 @@
+package users
+
+import (
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	PurposeConfirm     = "confirm"
+	PurposeReset       = "reset"
+	PurposeEmailChange = "email-change"
+	PurposeMagicLink   = "magic-link"
+	PurposeEmailRevert = "email-revert"
+	PurposeOrgInvite   = "org-invite"
+	PurposeUnlock      = "unlock"
+	PurposeExpired     = "password-expired"
+)
+
+// VerificationToken is a single-use emailed token bound to one purpose,
+// so a confirmation token can never be replayed as a reset token.
+// Only the hash of the token is stored.
+type VerificationToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	Purpose   string `gorm:"index;not null"`
+	TokenHash string `gorm:"index;not null"`
+	Payload   string
+	ExpiresAt time.Time `gorm:"index"`
+	UsedAt    *time.Time
+}
+
+// fixed tokens used when App.IsTest is set
+var testVerificationTokens = map[string]string{
+	PurposeConfirm:     "testchecktoken",
+	PurposeReset:       "testchecktoken",
+	PurposeEmailChange: "testemailtoken",
+	PurposeMagicLink:   "testmagictoken",
+	PurposeEmailRevert: "testreverttoken",
+	PurposeOrgInvite:   "testorginvitetoken",
+	PurposeUnlock:      "testunlocktoken",
+	PurposeExpired:     "testexpiredtoken",
+}
+
+func verificationTTL(purpose string) time.Duration {
+	switch purpose {
+	case PurposeConfirm:
+		return Config.ConfirmTokenTTL
+	case PurposeReset:
+		return Config.ResetTokenTTL
+	case PurposeEmailChange:
+		return Config.EmailChangeTokenTTL
+	case PurposeMagicLink:
+		return Config.MagicLinkTTL
+	case PurposeEmailRevert:
+		return Config.EmailRevertTokenTTL
+	case PurposeOrgInvite:
+		return Config.OrgInviteTTL
+	case PurposeUnlock:
+		return Config.LockoutDuration
+	case PurposeExpired:
+		return Config.PasswordChangeTTL
+	}
+	return time.Hour
+}
+
+// issueVerificationToken creates a new token for the purpose
+// and invalidates the unused ones the user already has for it.
+// Revert links are kept, a later change must not cancel an earlier revert,
+// and so are invitations, each one belongs to a different organization.
+func issueVerificationToken(userID uint, purpose, payload string) (string, error) {
+	var (
+		token string
+		err   error
+	)
+
+	if App.IsTest {
+		token = testVerificationTokens[purpose]
+	} else {
+		token, err = randomToken(32)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	tx := App.DB.Begin()
+
+	if purpose != PurposeEmailRevert && purpose != PurposeOrgInvite {
+		err = tx.Model(&VerificationToken{}).
+			Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+			Update("used_at", time.Now()).Error
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	err = tx.Create(&VerificationToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: App.ToSum256(token),
+		Payload:   payload,
+		ExpiresAt: time.Now().Add(verificationTTL(purpose)),
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	return token, tx.Commit().Error
+}
+
+// findVerificationToken looks up a valid token of the purpose without consuming it
+func findVerificationToken(token, purpose string) VerificationToken {
+	var vt VerificationToken
+
+	App.DB.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		App.ToSum256(token), purpose, time.Now()).
+		Order("id DESC").
+		First(&vt)
+
+	return vt
+}
+
+// useVerificationToken consumes a valid token of the purpose
+func useVerificationToken(token, purpose string) (VerificationToken, bool) {
+	vt := findVerificationToken(token, purpose)
+
+	if vt.ID == 0 {
+		return vt, false
+	}
+
+	res := App.DB.Model(&VerificationToken{}).
+		Where("id = ? AND used_at IS NULL", vt.ID).
+		Update("used_at", time.Now())
+
+	return vt, res.Error == nil && res.RowsAffected == 1
+}
+
+// migrateCheckTokens moves pending tokens from the old users.check_token
+// column into verification_tokens, they get a fresh expiry
+func migrateCheckTokens() {
+	var rows []struct {
+		ID         uint
+		Role       string
+		CheckToken string
+	}
+
+	if !App.DB.Dialect().HasColumn("users", "check_token") {
+		return
+	}
+
+	App.DB.Table("users").
+		Select("id, role, check_token").
+		Where("check_token IS NOT NULL AND check_token <> ''").
+		Scan(&rows)
+
+	for _, row := range rows {
+		purpose := PurposeReset
+		if row.Role == "" || row.Role == "candidate" {
+			purpose = PurposeConfirm
+		}
+
+		err := App.DB.Create(&VerificationToken{
+			UserID:    row.ID,
+			Purpose:   purpose,
+			TokenHash: App.ToSum256(row.CheckToken),
+			ExpiresAt: time.Now().Add(verificationTTL(purpose)),
+		}).Error
+		if err != nil {
+			log.Println("Data saving error: " + err.Error())
+			continue
+		}
+
+		App.DB.Table("users").Where("id = ?", row.ID).UpdateColumn("check_token", "")
+	}
+}